@@ -24,11 +24,13 @@ import (
 	"github.com/brancz/locutus/trigger/interval"
 	"github.com/brancz/locutus/trigger/oneoff"
 	"github.com/brancz/locutus/trigger/resource"
+	"github.com/brancz/locutus/trigger/rollouts"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -64,10 +66,111 @@ func (l *stringList) Set(value string) error {
 	return nil
 }
 
+// keyValues parses a list of key=value pairs.
+func (l stringList) keyValues() (map[string]string, error) {
+	m := map[string]string{}
+	for _, kv := range l {
+		split := strings.SplitN(kv, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid key=value pair: %s", kv)
+		}
+		m[split[0]] = split[1]
+	}
+	return m, nil
+}
+
+// ignoreDifferences parses a list of Kind.group:expression pairs.
+func (l stringList) ignoreDifferences() ([]*client.IgnoreDifferences, error) {
+	ignores := []*client.IgnoreDifferences{}
+	for _, v := range l {
+		split := strings.SplitN(v, ":", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid Kind.group:expression pair: %s", v)
+		}
+		gk := schema.ParseGroupKind(split[0])
+		d := &client.IgnoreDifferences{Group: gk.Group, Kind: gk.Kind}
+		if strings.HasPrefix(split[1], "/") {
+			d.JSONPointers = []string{split[1]}
+		} else {
+			d.JSONPaths = []string{split[1]}
+		}
+		if err := d.Validate(); err != nil {
+			return nil, err
+		}
+		ignores = append(ignores, d)
+	}
+	return ignores, nil
+}
+
+// readApprovalTokens reads bearer tokens and the approver they identify, one
+// per line in the form "<token> <approver>". Empty lines and lines starting
+// with # are ignored.
+func readApprovalTokens(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := map[string]string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<token> <approver>\"", path, i+1)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+
+	return tokens, nil
+}
+
+// clusterClients creates a client for each context of the kubeconfig, named
+// by the context. They count into the metrics of the main client.
+func clusterClients(logger log.Logger, main *client.Client, kubeconfig string, qps, burst int) (map[string]*client.Client, error) {
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig}
+	raw, err := rules.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load kubeconfig: %w", err)
+	}
+
+	clients := map[string]*client.Client{}
+	for name := range raw.Contexts {
+		konfig, err := clientcmd.NewNonInteractiveClientConfig(*raw, name, &clientcmd.ConfigOverrides{}, rules).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("build config of context %s: %w", name, err)
+		}
+		konfig.QPS = float32(qps)
+		konfig.Burst = burst
+
+		klient, err := kubernetes.NewForConfig(konfig)
+		if err != nil {
+			return nil, fmt.Errorf("build kubernetes clientset of context %s: %w", name, err)
+		}
+
+		c := client.NewClient(konfig, klient)
+		c.WithLogger(log.With(logger, "component", "client", "cluster", name))
+		c.ShareMetrics(main, name)
+		clients[name] = c
+	}
+
+	return clients, nil
+}
+
 func Main() int {
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		return historyMain(os.Args[2:])
+	}
+
 	var (
 		logLevel           string
 		masterURL          string
+		clustersKubeconfig string
 		kubeconfig         string
 		qps                int
 		burst              int
@@ -75,8 +178,34 @@ func Main() int {
 		writeStatus        bool
 		configFile         string
 		renderOnly         bool
+		dryRun             string
 		oneOff             bool
 
+		applyFieldManager   string
+		applyForceConflicts bool
+		canaryReplicas      int64
+		blueGreenDelay      time.Duration
+
+		stateNamespace    string
+		defaultNamespace  string
+		updateStrategy    string
+		prune             bool
+		pruneDryRun       bool
+		pruneAllowedKinds stringList
+
+		commonLabels      stringList
+		ignoreDiffs       stringList
+		commonAnnotations stringList
+		ownerReferences   bool
+
+		skipUnchanged        bool
+		driftDetect          bool
+		history              bool
+		historyRevisionLimit int
+
+		gatesListenAddress string
+		gatesTokensFile    string
+
 		rendererFileDirectory     string
 		rendererFileRollout       string
 		rendererJsonnetJpaths     stringList
@@ -91,6 +220,9 @@ func Main() int {
 		triggerIntervalDuration time.Duration
 		triggerResourceConfig   string
 		triggerDatabaseConfig   string
+		triggerRollouts         bool
+		triggerRolloutsNs       string
+		triggerRolloutsCluster  bool
 	)
 
 	s := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
@@ -99,10 +231,32 @@ func Main() int {
 	s.IntVar(&qps, "qps", 5, "QPS to use while talking with kubernetes API.")
 	s.IntVar(&burst, "burst", 10, "Burst to use while talking with kubernetes API.")
 	s.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	s.StringVar(&clustersKubeconfig, "clusters.kubeconfig", "", "Path to a kubeconfig with a context per cluster that groups and steps of rollouts may name as their cluster.")
 	s.StringVar(&renderProviderName, "renderer", "", "The provider to use for rendering manifests.")
 	s.StringVar(&configFile, "config-file", "", "The config file whose content to pass to the render provider.")
-	s.BoolVar(&renderOnly, "render-only", false, "Only render manifests to be rolled out and print to STDOUT.")
+	s.BoolVar(&renderOnly, "render-only", false, "Only render manifests to be rolled out and print to STDOUT. Deprecated: use --dry-run=client instead.")
+	s.StringVar(&dryRun, "dry-run", string(rollout.DryRunNone), fmt.Sprintf("Dry run strategy, one of %v. With \"client\" manifests are only rendered and printed to STDOUT, with \"server\" all actions are run as server-side dry runs and a diff per object is printed to STDOUT.", rollout.DryRunStrategies))
 	s.BoolVar(&oneOff, "one-off", false, "Only render and rollout once, then exit.")
+	s.StringVar(&applyFieldManager, "apply.field-manager", rollout.DefaultFieldManager, "Field manager name to use with the Apply action.")
+	s.BoolVar(&applyForceConflicts, "apply.force-conflicts", false, "Whether the Apply action takes ownership of fields owned by other field managers, instead of failing.")
+	s.Int64Var(&canaryReplicas, "canary.replicas", rollout.DefaultCanaryReplicas, "Number of replicas of canaries rolled out by the Canary action.")
+	s.DurationVar(&blueGreenDelay, "blue-green.delete-delay", rollout.DefaultBlueGreenDeleteDelay, "How long the BlueGreen action keeps the previous color after switching the Service to the new one.")
+	s.StringVar(&stateNamespace, "state-namespace", "default", "Namespace to store state, such as inventories of applied objects, in.")
+	s.StringVar(&updateStrategy, "update-strategy", string(client.UpdateStrategyReplace), fmt.Sprintf("How existing objects are updated, one of %v. \"ThreeWayMerge\" records applied objects in the %s annotation and deletes fields removed since, while keeping fields set by others, the way kubectl apply does.", client.UpdateStrategies, client.LastAppliedAnnotation))
+	s.StringVar(&defaultNamespace, "default-namespace", "default", "Namespace of rendered namespaced objects that don't specify one.")
+	s.BoolVar(&prune, "prune", false, "Delete objects applied by an earlier execution that are no longer rendered. Applied objects are tracked in an inventory per trigger key.")
+	s.BoolVar(&pruneDryRun, "prune.dry-run", false, "Only log objects that would be pruned, instead of deleting them.")
+	s.Var(&pruneAllowedKinds, "prune.allowed-kinds", "Kinds that may be pruned, in the form Kind.group, for example Deployment.apps or ConfigMap. All kinds may be pruned if not set.")
+	s.Var(&ignoreDiffs, "ignore-differences", "Field kept as it is in the cluster when objects are updated, in the form Kind.group:expression, for example Deployment.apps:/spec/replicas. Expressions starting with / are JSON pointers, others JSONPath expressions.")
+	s.Var(&commonLabels, "common-labels", "Label to add to all rendered objects, in the form key=value. Labels set on rendered objects take precedence.")
+	s.Var(&commonAnnotations, "common-annotations", "Annotation to add to all rendered objects, in the form key=value. Annotations set on rendered objects take precedence.")
+	s.BoolVar(&ownerReferences, "owner-references", false, "Set the resource that triggered an execution as the controller of the rendered objects, so that they are garbage collected when it is deleted. Only objects the resource is allowed to own are changed.")
+	s.BoolVar(&skipUnchanged, "skip-unchanged", false, "Stamp a hash of each rendered object into the locutus.io/content-hash annotation, and skip updating objects whose live annotation matches. Changes made to live objects by others are then only reverted once the rendered object changes. Has no effect with --drift-detect, which compares every object.")
+	s.BoolVar(&driftDetect, "drift-detect", false, "Only compare rendered objects with their live state, ignoring fields populated by the API server, instead of rolling them out. Drifted objects are logged with a diff and reported through the locutus_object_drift metric. Meant to be run with the interval trigger, nothing is changed in the cluster.")
+	s.BoolVar(&history, "history", false, "Record a history of executions per trigger key in a Secret, readable through the \"history\" subcommand.")
+	s.IntVar(&historyRevisionLimit, "history.revision-limit", rollout.DefaultHistoryRevisionLimit, "Number of executions kept in the history per trigger key.")
+	s.StringVar(&gatesListenAddress, "gates.listen-address", "", "Address to serve /gates on, to list and approve gates waiting for approval over HTTP. Disabled if not set, requires --gates.tokens-file.")
+	s.StringVar(&gatesTokensFile, "gates.tokens-file", "", "File with a bearer token and the approver it identifies per line, in the form \"<token> <approver>\". Requests to /gates must carry one of the tokens, gates are approved in the name of its approver.")
 	s.StringVar(&databaseConnectionsFile, "database-connections-file", "", "File to read database connections from.")
 	s.StringVar(&defaultDatabaseUrlFile, "default-database-url-file", "", "File to read default database URL from.")
 
@@ -117,6 +271,9 @@ func Main() int {
 	s.DurationVar(&triggerIntervalDuration, "trigger.interval.duration", time.Duration(0), "Duration of interval in which to trigger.")
 	s.StringVar(&triggerResourceConfig, "trigger.resource.config", "", "Path to configuration of resource triggers.")
 	s.StringVar(&triggerDatabaseConfig, "trigger.database.config", "", "Path to configuration of database triggers.")
+	s.BoolVar(&triggerRollouts, "trigger.rollouts", false, "Execute Rollout objects in the cluster whenever they change, writing their progress into their status. Requires the Rollout CRD, no renderer is needed.")
+	s.StringVar(&triggerRolloutsNs, "trigger.rollouts.namespace", "", "Namespace to watch Rollout objects in, all namespaces if not set.")
+	s.BoolVar(&triggerRolloutsCluster, "trigger.rollouts.allow-cluster-scoped", false, "Whether Rollout objects may roll out cluster-scoped objects. Rollout objects can only roll out objects into their own namespace, and no cluster-scoped objects unless set.")
 	s.BoolVar(&writeStatus, "trigger.resource.write-status", true, "Whether to write status back to the originating resource.")
 
 	if err := s.Parse(os.Args[1:]); err != nil {
@@ -129,10 +286,56 @@ func Main() int {
 		return 1
 	}
 
+	dryRunStrategy := rollout.DryRunStrategy(dryRun)
+	if renderOnly {
+		dryRunStrategy = rollout.DryRunClient
+	}
+	switch dryRunStrategy {
+	case rollout.DryRunNone, rollout.DryRunClient, rollout.DryRunServer:
+	default:
+		fmt.Printf("dry run strategy %v unknown, %v are possible values\n", dryRun, rollout.DryRunStrategies)
+		return 1
+	}
+	switch client.UpdateStrategy(updateStrategy) {
+	case client.UpdateStrategyReplace, client.UpdateStrategyThreeWayMerge:
+	default:
+		fmt.Printf("update strategy %v unknown, %v are possible values\n", updateStrategy, client.UpdateStrategies)
+		return 1
+	}
+
+	var approvalTokens map[string]string
+	if gatesListenAddress != "" {
+		if gatesTokensFile == "" {
+			fmt.Println("--gates.listen-address requires --gates.tokens-file")
+			return 1
+		}
+		approvalTokens, err = readApprovalTokens(gatesTokensFile)
+		if err != nil {
+			logger.Log("msg", "failed to read gate tokens", "err", err)
+			return 1
+		}
+	}
+
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(prometheus.NewGoCollector())
 	reg.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 
+	// Drift detection compares every rendered object with its live state,
+	// skipping objects by their content hash would hide drift.
+	if driftDetect && skipUnchanged {
+		level.Info(logger).Log("msg", "--skip-unchanged has no effect with --drift-detect")
+		skipUnchanged = false
+	}
+	updateChecks := append([]client.UpdateCheck{}, client.DefaultUpdateChecks...)
+	if skipUnchanged {
+		updateChecks = append(updateChecks, client.UpdateCheckFunc(client.CheckContentHashForUpdate))
+	}
+	ignoreDifferences, err := ignoreDiffs.ignoreDifferences()
+	if err != nil {
+		logger.Log("msg", "invalid ignore differences", "err", err)
+		return 1
+	}
+
 	var cl *client.Client
 	{
 		konfig, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
@@ -151,8 +354,28 @@ func Main() int {
 
 		cl = client.NewClient(konfig, klient)
 		cl.WithLogger(log.With(logger, "component", "client"))
+		cl.WithRegisterer(reg)
 		cl.SetUpdatePreparations(client.DefaultUpdatePreparations)
-		cl.SetUpdateChecks(client.DefaultUpdateChecks)
+		cl.SetUpdateChecks(updateChecks)
+		cl.SetDefaultNamespace(defaultNamespace)
+		cl.SetIgnoreDifferences(ignoreDifferences)
+		cl.SetUpdateStrategy(client.UpdateStrategy(updateStrategy))
+	}
+
+	var clusters map[string]*client.Client
+	if clustersKubeconfig != "" {
+		clusters, err = clusterClients(logger, cl, clustersKubeconfig, qps, burst)
+		if err != nil {
+			logger.Log("msg", "error building cluster clients", "err", err)
+			return 1
+		}
+		for _, c := range clusters {
+			c.SetUpdatePreparations(client.DefaultUpdatePreparations)
+			c.SetUpdateChecks(updateChecks)
+			c.SetDefaultNamespace(defaultNamespace)
+			c.SetIgnoreDifferences(ignoreDifferences)
+			c.SetUpdateStrategy(client.UpdateStrategy(updateStrategy))
+		}
 	}
 
 	ctx := context.Background()
@@ -175,6 +398,16 @@ func Main() int {
 		triggers = append(triggers, t)
 	}
 
+	if triggerRollouts {
+		t, err := rollouts.NewTrigger(ctx, logger, cl, triggerRolloutsNs, triggerRolloutsCluster)
+		if err != nil {
+			logger.Log("msg", "failed to create rollouts trigger", "err", err)
+			return 1
+		}
+
+		triggers = append(triggers, t)
+	}
+
 	if triggerIntervalDuration > 0 {
 		triggers = append(triggers, interval.NewTrigger(logger, triggerIntervalDuration))
 	}
@@ -252,6 +485,12 @@ func Main() int {
 			}
 		case "file":
 			renderer = file.NewRenderer(logger, rendererFileDirectory, rendererFileRollout)
+		case "":
+			// Rollouts watched in the cluster are executed as they are.
+			if !triggerRollouts {
+				logger.Log("msg", "failed to find render provider")
+				return 1
+			}
 		default:
 			logger.Log("msg", "failed to find render provider")
 			return 1
@@ -263,11 +502,72 @@ func Main() int {
 		logger.Log("msg", "failed to create checks", "err", err)
 		return 1
 	}
-	runner := rollout.NewRunner(reg, log.With(logger, "component", "rollout-runner"), cl, renderer, c, renderOnly)
+	runner := rollout.NewRunner(reg, log.With(logger, "component", "rollout-runner"), cl, renderer, c, dryRunStrategy)
+	allowedKinds := []schema.GroupKind{}
+	for _, k := range pruneAllowedKinds {
+		allowedKinds = append(allowedKinds, schema.ParseGroupKind(k))
+	}
+	runner.SetPruneConfig(rollout.PruneConfig{
+		Enabled:      prune,
+		DryRun:       pruneDryRun,
+		AllowedKinds: allowedKinds,
+		Namespace:    stateNamespace,
+	})
+	var approvals *rollout.Approvals
+	if gatesListenAddress != "" {
+		approvals = rollout.NewApprovals()
+		runner.SetApprovals(approvals)
+	}
+	runner.SetDatabaseConnections(databaseConnections)
+	runner.SetContentHash(skipUnchanged)
+	runner.SetClusters(clusters)
+	runner.SetDriftDetection(driftDetect)
+	runner.SetHistoryConfig(rollout.HistoryConfig{
+		Enabled:       history,
+		RevisionLimit: historyRevisionLimit,
+		Namespace:     stateNamespace,
+	})
+	labels, err := commonLabels.keyValues()
+	if err != nil {
+		logger.Log("msg", "invalid common labels", "err", err)
+		return 1
+	}
+	annotations, err := commonAnnotations.keyValues()
+	if err != nil {
+		logger.Log("msg", "invalid common annotations", "err", err)
+		return 1
+	}
+	mutations := []rollout.ObjectMutation{}
+	if len(labels) > 0 || len(annotations) > 0 {
+		mutations = append(mutations, &rollout.CommonMetadataMutation{
+			Labels:      labels,
+			Annotations: annotations,
+		})
+	}
+	if ownerReferences {
+		mutations = append(mutations, &rollout.OwnerReferenceMutation{
+			Logger: log.With(logger, "component", "owner-references"),
+			Client: cl,
+		})
+	}
+	runner.SetObjectMutations(mutations)
 	runner.SetObjectActions(rollout.DefaultObjectActions)
-
-	for _, trigger := range triggers {
-		trigger.Register(config.NewFileConfigPasser(configFile, runner))
+	runner.SetObjectActions([]rollout.ObjectAction{
+		&rollout.ApplyObjectAction{
+			FieldManager: applyFieldManager,
+			Force:        applyForceConflicts,
+		},
+		&rollout.CanaryObjectAction{
+			Replicas: canaryReplicas,
+		},
+		&rollout.BlueGreenObjectAction{
+			DeleteDelay: blueGreenDelay,
+		},
+	})
+
+	coordinator := trigger.NewCoordinator(reg, log.With(logger, "component", "coordinator"), runner)
+	for _, t := range triggers {
+		t.Register(config.NewFileConfigPasser(configFile, coordinator))
 	}
 
 	mux := http.NewServeMux()
@@ -293,6 +593,22 @@ func Main() int {
 			l.Close()
 		})
 	}
+	if approvals != nil {
+		gatesMux := http.NewServeMux()
+		gatesMux.Handle("/gates", rollout.NewApprovalHandler(approvals, approvalTokens))
+		gatesSrv := &http.Server{Handler: gatesMux}
+
+		l, err := net.Listen("tcp", gatesListenAddress)
+		if err != nil {
+			logger.Log("msg", "listening on gates address failed", "address", gatesListenAddress, "err", err)
+			return 1
+		}
+		g.Add(func() error {
+			return gatesSrv.Serve(l)
+		}, func(err error) {
+			l.Close()
+		})
+	}
 	for _, trigger := range triggers {
 		ctx, cancel := context.WithCancel(ctx)
 		g.Add(func() error {
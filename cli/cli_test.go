@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/rest"
+
+	"github.com/brancz/locutus/client"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster:
+    server: https://remote.example.com
+users:
+- name: remote
+  user:
+    token: token
+contexts:
+- name: remote
+  context:
+    cluster: remote
+    user: remote
+`
+
+func TestClusterClientsShareMetrics(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := os.WriteFile(kubeconfig, []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	main := client.NewClient(&rest.Config{Host: "https://main.example.com"}, nil)
+	main.WithRegisterer(reg)
+
+	clusters, err := clusterClients(log.NewNopLogger(), main, kubeconfig, 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := clusters["remote"]; !ok {
+		t.Fatalf("expected a client for the remote context, got %v", clusters)
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadApprovalTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("# release managers\ns3cret jane\n\nt0ken john\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := readApprovalTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens["s3cret"] != "jane" || tokens["t0ken"] != "john" {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readApprovalTokens(path); err == nil {
+		t.Fatal("expected a line without approver to be rejected")
+	}
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/brancz/locutus/rollout"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// historyMain implements the history subcommand, which prints the recorded
+// executions of a trigger key.
+func historyMain(args []string) int {
+	var (
+		masterURL      string
+		kubeconfig     string
+		stateNamespace string
+		key            string
+		revision       int
+		printRender    bool
+	)
+
+	s := flag.NewFlagSet(os.Args[0]+" history", flag.ExitOnError)
+	s.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
+	s.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	s.StringVar(&stateNamespace, "state-namespace", "default", "Namespace the history is stored in.")
+	s.StringVar(&key, "key", "", "Trigger key to print the history of. Lists all keys with a history if not set.")
+	s.IntVar(&revision, "revision", 0, "Revision to print the steps of.")
+	s.BoolVar(&printRender, "render", false, "Print the render result of the revision as JSON.")
+
+	if err := s.Parse(args); err != nil {
+		return 1
+	}
+
+	konfig, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error building kubeconfig: %v\n", err)
+		return 1
+	}
+	klient, err := kubernetes.NewForConfig(konfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error building kubernetes clientset: %v\n", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	if key == "" {
+		keys, err := rollout.HistoryKeys(ctx, klient, stateNamespace)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, k := range keys {
+			fmt.Println(k)
+		}
+		return 0
+	}
+
+	entries, err := rollout.ReadHistory(ctx, klient, stateNamespace, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	if revision == 0 {
+		rollout.PrintHistory(w, entries)
+		return 0
+	}
+
+	for _, e := range entries {
+		if e.Revision != revision {
+			continue
+		}
+
+		if !printRender {
+			rollout.PrintHistoryEntry(w, e)
+			return 0
+		}
+
+		res, err := e.RenderResult()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "decompress render result: %v\n", err)
+			return 1
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(res); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "revision %d not found for key %q\n", revision, key)
+	return 1
+}
@@ -3,18 +3,25 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	gocmp "github.com/google/go-cmp/cmp"
 	gocmpopts "github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 )
 
 var (
@@ -47,19 +54,59 @@ func (f UpdateCheckFunc) Check(current, updated *unstructured.Unstructured) (boo
 	return f(current, updated)
 }
 
+type clientMetrics struct {
+	updates *prometheus.CounterVec
+	// cluster labels the updates of the client, empty for the main
+	// cluster.
+	cluster string
+}
+
 type Client struct {
-	kclient            kubernetes.Interface
-	cfg                *rest.Config
+	kclient kubernetes.Interface
+	cfg     *rest.Config
+	// dynamic is shared by all resource clients, dynamicErr is returned
+	// when creating it failed.
+	dynamic    dynamic.Interface
+	dynamicErr error
+	// mapper caches discovery, it is reset when a lookup misses or
+	// CustomResourceDefinitions change.
+	discovery discovery.CachedDiscoveryInterface
+	mapper    *restmapper.DeferredDiscoveryRESTMapper
+	// lastMissReset is when a lookup miss last reset the mapper, guarded
+	// by missResetMtx.
+	missResetMtx       sync.Mutex
+	lastMissReset      time.Time
+	defaultNamespace   string
 	updatePreparations []UpdatePreparation
 	updateChecks       []UpdateCheck
+	ignoreDifferences  []*IgnoreDifferences
+	updateStrategy     UpdateStrategy
 	logger             log.Logger
+	metrics            *clientMetrics
 }
 
 func NewClient(cfg *rest.Config, kclient kubernetes.Interface) *Client {
 	c := &Client{
-		logger:  log.NewNopLogger(),
-		kclient: kclient,
-		cfg:     cfg,
+		logger:           log.NewNopLogger(),
+		kclient:          kclient,
+		cfg:              cfg,
+		defaultNamespace: corev1.NamespaceDefault,
+		metrics: &clientMetrics{
+			updates: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "client_updates_total",
+				Help: "Total number of updates of existing objects, by cluster and whether they were applied or skipped as unnecessary.",
+			}, []string{"cluster", "result"}),
+		},
+	}
+
+	if kclient != nil {
+		c.discovery = memory.NewMemCacheClient(kclient.Discovery())
+		c.mapper = restmapper.NewDeferredDiscoveryRESTMapper(c.discovery)
+	}
+	if cfg != nil {
+		c.dynamic, c.dynamicErr = dynamic.NewForConfig(cfg)
+	} else {
+		c.dynamicErr = errors.New("no REST config to create a dynamic client with")
 	}
 
 	return c
@@ -73,6 +120,16 @@ func (c *Client) WithLogger(logger log.Logger) {
 	c.logger = logger
 }
 
+func (c *Client) WithRegisterer(r prometheus.Registerer) {
+	r.MustRegister(c.metrics.updates)
+}
+
+// ShareMetrics makes the client count into the metrics of the main client,
+// labelled with the cluster, instead of registering its own.
+func (c *Client) ShareMetrics(main *Client, cluster string) {
+	c.metrics = &clientMetrics{updates: main.metrics.updates, cluster: cluster}
+}
+
 func (c *Client) SetUpdatePreparations(preparations []UpdatePreparation) {
 	c.updatePreparations = preparations
 }
@@ -81,65 +138,142 @@ func (c *Client) SetUpdateChecks(checks []UpdateCheck) {
 	c.updateChecks = checks
 }
 
-func (c *Client) ClientForUnstructured(u *unstructured.Unstructured) (*ResourceClient, error) {
-	return c.ClientFor(u.GetAPIVersion(), u.GetKind(), u.GetNamespace())
+// SetUpdateStrategy sets how existing objects are updated,
+// UpdateStrategyReplace unless set.
+func (c *Client) SetUpdateStrategy(strategy UpdateStrategy) {
+	c.updateStrategy = strategy
 }
 
-func (c *Client) ClientFor(apiVersion, kind, namespace string) (*ResourceClient, error) {
+// SetIgnoreDifferences sets the fields kept as they are in the cluster on
+// update, for all objects.
+func (c *Client) SetIgnoreDifferences(ignoreDifferences []*IgnoreDifferences) {
+	c.ignoreDifferences = ignoreDifferences
+}
+
+// SetDynamicClient sets the dynamic client shared by all resource clients,
+// instead of the one created from the REST config.
+func (c *Client) SetDynamicClient(d dynamic.Interface) {
+	c.dynamic, c.dynamicErr = d, nil
+}
 
-	apiResourceList, err := c.kclient.Discovery().ServerResourcesForGroupVersion(apiVersion)
+// SetDefaultNamespace sets the namespace of namespaced objects that don't
+// specify one, "default" unless set.
+func (c *Client) SetDefaultNamespace(namespace string) {
+	c.defaultNamespace = namespace
+}
+
+// ObjectNamespace returns the namespace the object is placed in: its own,
+// the default namespace for namespaced objects without one, and none for
+// cluster-scoped objects. Anything locating objects by their namespace must
+// use it, rather than the namespace of the object as rendered.
+func (c *Client) ObjectNamespace(u *unstructured.Unstructured) (string, error) {
+	namespaced, err := c.IsNamespaced(u.GetAPIVersion(), u.GetKind())
 	if err != nil {
-		return nil, errors.Wrapf(err, "discovering resource information failed for %s in %s", kind, apiVersion)
+		return "", err
+	}
+	if !namespaced {
+		return "", nil
 	}
+	if u.GetNamespace() == "" {
+		return c.defaultNamespace, nil
+	}
+	return u.GetNamespace(), nil
+}
 
-	dc, err := newForConfig(apiResourceList.GroupVersion, c.cfg)
+// ClientForUnstructured returns a client for the object in the namespace
+// returned by ObjectNamespace.
+func (c *Client) ClientForUnstructured(u *unstructured.Unstructured) (*ResourceClient, error) {
+	namespace, err := c.ObjectNamespace(u)
 	if err != nil {
-		return nil, errors.Wrapf(err, "creating dynamic client failed for %s", apiResourceList.GroupVersion)
+		return nil, err
 	}
 
-	gv, err := schema.ParseGroupVersion(apiResourceList.GroupVersion)
+	return c.ClientFor(u.GetAPIVersion(), u.GetKind(), namespace)
+}
+
+// ClientFor returns a client for the kind in the namespace, or in all
+// namespaces if it is empty. The namespace is ignored for cluster-scoped
+// kinds. If the API server doesn't serve the kind, an *UnknownKindError is
+// returned.
+func (c *Client) ClientFor(apiVersion, kind, namespace string) (*ResourceClient, error) {
+	mapping, err := c.restMapping(apiVersion, kind)
 	if err != nil {
-		return nil, errors.Wrapf(err, "parsing GroupVersion failed %s", apiResourceList.GroupVersion)
+		return nil, err
 	}
-
-	resourceName := ""
-	for _, r := range apiResourceList.APIResources {
-		if r.Kind == kind {
-			resourceName = r.Name
-			break
-		}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		namespace = ""
+	}
+	if c.dynamicErr != nil {
+		return nil, errors.Wrap(c.dynamicErr, "creating dynamic client failed")
 	}
 
-	gvr := schema.GroupVersionResource{
-		Group:    gv.Group,
-		Version:  gv.Version,
-		Resource: resourceName,
+	ri := dynamic.ResourceInterface(c.dynamic.Resource(mapping.Resource).Namespace(namespace))
+	if mapping.GroupVersionKind.GroupKind() == customResourceDefinitionGroupKind {
+		ri = &crdResourceInterface{ResourceInterface: ri, reset: c.mapper.Reset}
 	}
 
-	return &ResourceClient{ResourceInterface: dc.Resource(gvr).Namespace(namespace), updatePreparations: c.updatePreparations, updateChecks: c.updateChecks}, nil
+	return &ResourceClient{
+		ResourceInterface:  ri,
+		updatePreparations: c.updatePreparations,
+		updateChecks:       c.updateChecks,
+		ignoreDifferences:  c.ignoreDifferences,
+		updateStrategy:     c.updateStrategy,
+		metrics:            c.metrics,
+	}, nil
 }
 
-func newForConfig(groupVersion string, c *rest.Config) (dynamic.Interface, error) {
-	config := *c
-	err := setConfigDefaults(groupVersion, &config)
+// IsNamespaced returns whether objects of the kind are namespaced.
+func (c *Client) IsNamespaced(apiVersion, kind string) (bool, error) {
+	mapping, err := c.restMapping(apiVersion, kind)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return dynamic.NewForConfig(&config)
+	return mapping.Scope.Name() == meta.RESTScopeNameNamespace, nil
+}
+
+// missResetInterval is the minimum time between resets of the discovery cache
+// caused by lookup misses, so that repeated lookups of kinds the API server
+// doesn't serve don't rediscover all APIs every time. Changes to
+// CustomResourceDefinitions made through the client always reset it.
+const missResetInterval = 10 * time.Second
+
+// resetOnMiss resets the discovery cache after a lookup miss, unless a miss
+// did so within the missResetInterval. It returns whether it was reset.
+func (c *Client) resetOnMiss() bool {
+	c.missResetMtx.Lock()
+	defer c.missResetMtx.Unlock()
+
+	if !c.lastMissReset.IsZero() && time.Since(c.lastMissReset) < missResetInterval {
+		return false
+	}
+	c.lastMissReset = time.Now()
+	c.mapper.Reset()
+	return true
 }
 
-func setConfigDefaults(groupVersion string, config *rest.Config) error {
-	gv, err := schema.ParseGroupVersion(groupVersion)
+// restMapping looks up the resource of the kind in the discovery cache. On a
+// miss the cache is reset, at most once per missResetInterval, and the lookup
+// retried once, as the kind may have been added since the cache was filled.
+func (c *Client) restMapping(apiVersion, kind string) (*meta.RESTMapping, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "parsing GroupVersion failed %s", apiVersion)
 	}
-	config.GroupVersion = &gv
-	config.APIPath = "/apis"
-	if config.GroupVersion.Group == "" && config.GroupVersion.Version == "v1" {
-		config.APIPath = "/api"
+	gk := schema.GroupKind{Group: gv.Group, Kind: kind}
+
+	mapping, err := c.mapper.RESTMapping(gk, gv.Version)
+	if meta.IsNoMatchError(err) && c.resetOnMiss() {
+		mapping, err = c.mapper.RESTMapping(gk, gv.Version)
 	}
-	return nil
+	if meta.IsNoMatchError(err) {
+		return nil, &UnknownKindError{APIVersion: apiVersion, Kind: kind, Similar: similarKinds(c.discovery, apiVersion, kind)}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "discovering resource information failed for %s in %s", kind, apiVersion)
+	}
+
+	return mapping, nil
 }
 
 type ResourceClient struct {
@@ -147,9 +281,67 @@ type ResourceClient struct {
 
 	updatePreparations []UpdatePreparation
 	updateChecks       []UpdateCheck
+	ignoreDifferences  []*IgnoreDifferences
+	updateStrategy     UpdateStrategy
+	// metrics is nil for clients not created through a Client.
+	metrics *clientMetrics
+}
+
+// WithResourceInterface returns a copy of the client that talks to the API
+// through the given interface, for example to intercept requests.
+func (rc *ResourceClient) WithResourceInterface(ri dynamic.ResourceInterface) *ResourceClient {
+	c := *rc
+	c.ResourceInterface = ri
+	return &c
+}
+
+// WithUpdateStrategy returns a copy of the client that updates objects with
+// the given strategy.
+func (rc *ResourceClient) WithUpdateStrategy(strategy UpdateStrategy) *ResourceClient {
+	c := *rc
+	c.updateStrategy = strategy
+	return &c
+}
+
+// WithIgnoreDifferences returns a copy of the client that additionally keeps
+// the given fields as they are in the cluster on update.
+func (rc *ResourceClient) WithIgnoreDifferences(ignoreDifferences ...*IgnoreDifferences) *ResourceClient {
+	c := *rc
+	c.ignoreDifferences = append(append([]*IgnoreDifferences{}, rc.ignoreDifferences...), ignoreDifferences...)
+	return &c
+}
+
+// CopyIgnoredFields copies the fields ignored by the client from the current
+// to the updated object. UpdateWithCurrent does so on its own, it is for
+// changes made otherwise, such as server-side apply.
+func (rc *ResourceClient) CopyIgnoredFields(current, updated *unstructured.Unstructured) error {
+	for _, d := range rc.ignoreDifferences {
+		if err := d.Prepare(current, updated); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
+// HasIgnoredFields returns whether the client ignores any fields of the
+// object.
+func (rc *ResourceClient) HasIgnoredFields(u *unstructured.Unstructured) bool {
+	for _, d := range rc.ignoreDifferences {
+		if d.matches(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateWithCurrent updates the current object to the updated one, according
+// to the client's update strategy. Subresources are always replaced.
 func (rc *ResourceClient) UpdateWithCurrent(ctx context.Context, current, updated *unstructured.Unstructured, subresources ...string) (*unstructured.Unstructured, error) {
+	if rc.updateStrategy == UpdateStrategyThreeWayMerge && len(subresources) == 0 {
+		return rc.threeWayMergeUpdate(ctx, current, updated)
+	}
+
 	if err := rc.prepareUnstructuredForUpdate(current, updated); err != nil {
 		return nil, err
 	}
@@ -159,10 +351,24 @@ func (rc *ResourceClient) UpdateWithCurrent(ctx context.Context, current, update
 		return nil, err
 	}
 	if !needUpdate {
+		rc.countUpdate("skipped")
 		return nil, nil
 	}
 
-	return rc.ResourceInterface.Update(ctx, updated, v1.UpdateOptions{}, subresources...)
+	u, err := rc.ResourceInterface.Update(ctx, updated, v1.UpdateOptions{}, subresources...)
+	if err != nil {
+		return nil, err
+	}
+	rc.countUpdate("applied")
+
+	return u, nil
+}
+
+func (rc *ResourceClient) countUpdate(result string) {
+	if rc.metrics == nil {
+		return
+	}
+	rc.metrics.updates.WithLabelValues(rc.metrics.cluster, result).Inc()
 }
 
 func (rc *ResourceClient) prepareUnstructuredForUpdate(current, updated *unstructured.Unstructured) error {
@@ -174,7 +380,7 @@ func (rc *ResourceClient) prepareUnstructuredForUpdate(current, updated *unstruc
 		}
 	}
 
-	return nil
+	return rc.CopyIgnoredFields(current, updated)
 }
 
 func (rc *ResourceClient) checkUnstructuredForUpdate(current, updated *unstructured.Unstructured) (bool, error) {
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRESTMappingResetsOnMiss(t *testing.T) {
+	kc := kubefake.NewSimpleClientset()
+	disc := kc.Discovery().(*fakediscovery.FakeDiscovery)
+	disc.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{{Name: "configmaps", Kind: "ConfigMap", Namespaced: true}},
+	}}
+	c := NewClient(nil, kc)
+
+	if _, err := c.IsNamespaced("example.com/v1", "Widget"); err == nil {
+		t.Fatal("expected unknown kind to fail")
+	}
+
+	// The kind appears, as if a CustomResourceDefinition had been created.
+	disc.Resources = append(disc.Resources, &metav1.APIResourceList{
+		GroupVersion: "example.com/v1",
+		APIResources: []metav1.APIResource{{Name: "widgets", Kind: "Widget", Namespaced: false}},
+	})
+
+	// The cache was just reset by the first miss, so it isn't again.
+	if _, err := c.IsNamespaced("example.com/v1", "Widget"); err == nil {
+		t.Fatal("expected the discovery cache not to be reset again right away")
+	}
+
+	c.lastMissReset = c.lastMissReset.Add(-missResetInterval)
+	namespaced, err := c.IsNamespaced("example.com/v1", "Widget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespaced {
+		t.Fatal("expected Widget to be cluster-scoped")
+	}
+}
+
+func TestUnknownKindError(t *testing.T) {
+	kc := kubefake.NewSimpleClientset()
+	kc.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "rbac.authorization.k8s.io/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "clusterroles", Kind: "ClusterRole"},
+			{Name: "roles", Kind: "Role", Namespaced: true},
+			{Name: "rolebindings", Kind: "RoleBinding", Namespaced: true},
+		},
+	}}
+	c := NewClient(nil, kc)
+
+	_, err := c.ClientFor("v1", "role", "default")
+	var unknown *UnknownKindError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("expected UnknownKindError, got %v", err)
+	}
+	expected := []string{
+		"ClusterRole in rbac.authorization.k8s.io/v1",
+		"Role in rbac.authorization.k8s.io/v1",
+		"RoleBinding in rbac.authorization.k8s.io/v1",
+	}
+	if !reflect.DeepEqual(unknown.Similar, expected) {
+		t.Fatalf("expected similar kinds %v, got %v", expected, unknown.Similar)
+	}
+}
+
+func TestObjectNamespace(t *testing.T) {
+	kc := kubefake.NewSimpleClientset()
+	kc.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "configmaps", Kind: "ConfigMap", Namespaced: true},
+			{Name: "namespaces", Kind: "Namespace", Namespaced: false},
+		},
+	}}
+	c := NewClient(nil, kc)
+	c.SetDefaultNamespace("apps")
+
+	for _, tc := range []struct {
+		kind, namespace, expected string
+	}{
+		{kind: "ConfigMap", namespace: "", expected: "apps"},
+		{kind: "ConfigMap", namespace: "other", expected: "other"},
+		{kind: "Namespace", namespace: "other", expected: ""},
+	} {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("v1")
+		u.SetKind(tc.kind)
+		u.SetNamespace(tc.namespace)
+		namespace, err := c.ObjectNamespace(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if namespace != tc.expected {
+			t.Fatalf("expected namespace %q for %s in %q, got %q", tc.expected, tc.kind, tc.namespace, namespace)
+		}
+	}
+}
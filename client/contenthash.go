@@ -0,0 +1,69 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// ContentHashAnnotation holds the hash of the rendered object, as it was
+	// last applied.
+	ContentHashAnnotation = "locutus.io/content-hash"
+)
+
+// ContentHash returns the hash of the object, ignoring fields populated by
+// the API server and the content hash annotation itself.
+func ContentHash(u *unstructured.Unstructured) (string, error) {
+	u = u.DeepCopy()
+	for _, field := range []string{"managedFields", "resourceVersion", "generation", "uid", "creationTimestamp", "deletionTimestamp", "selfLink"} {
+		unstructured.RemoveNestedField(u.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(u.Object, "metadata", "annotations", ContentHashAnnotation)
+	unstructured.RemoveNestedField(u.Object, "status")
+	if annotations, found, _ := unstructured.NestedMap(u.Object, "metadata", "annotations"); found && len(annotations) == 0 {
+		unstructured.RemoveNestedField(u.Object, "metadata", "annotations")
+	}
+
+	// Maps are marshalled with sorted keys, so the result is stable.
+	b, err := json.Marshal(u.Object)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// SetContentHash stamps the hash of the object into its content hash
+// annotation.
+func SetContentHash(u *unstructured.Unstructured) error {
+	hash, err := ContentHash(u)
+	if err != nil {
+		return err
+	}
+
+	annotations := u.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ContentHashAnnotation] = hash
+	u.SetAnnotations(annotations)
+
+	return nil
+}
+
+// CheckContentHashForUpdate skips updating objects whose content hash
+// annotation matches the live object's, meaning the rendered object didn't
+// change since it was last applied. Changes made to the live object by
+// others are not detected.
+func CheckContentHashForUpdate(current, updated *unstructured.Unstructured) (bool, error) {
+	hash, ok := updated.GetAnnotations()[ContentHashAnnotation]
+	if !ok {
+		return true, nil
+	}
+
+	return current.GetAnnotations()[ContentHashAnnotation] != hash, nil
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func configMap(value string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":      "test",
+				"namespace": "default",
+			},
+			"data": map[string]interface{}{
+				"key": value,
+			},
+		},
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	rendered := configMap("value")
+	if err := SetContentHash(rendered); err != nil {
+		t.Fatal(err)
+	}
+
+	live := rendered.DeepCopy()
+	live.SetResourceVersion("42")
+	live.SetUID("abc")
+	liveHash, err := ContentHash(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if liveHash != rendered.GetAnnotations()[ContentHashAnnotation] {
+		t.Fatal("expected hash to ignore server populated fields and the hash annotation")
+	}
+
+	changed := configMap("changed")
+	if err := SetContentHash(changed); err != nil {
+		t.Fatal(err)
+	}
+	if changed.GetAnnotations()[ContentHashAnnotation] == liveHash {
+		t.Fatal("expected hash to change with the object")
+	}
+}
+
+func TestUpdateWithCurrentSkipsUnchanged(t *testing.T) {
+	ctx := context.Background()
+	live := configMap("value")
+	if err := SetContentHash(live); err != nil {
+		t.Fatal(err)
+	}
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), live)
+	c := NewClient(nil, nil)
+	rc := &ResourceClient{
+		ResourceInterface: dc.Resource(gvr).Namespace("default"),
+		updateChecks:      []UpdateCheck{UpdateCheckFunc(CheckContentHashForUpdate)},
+		metrics:           c.metrics,
+	}
+
+	unchanged := configMap("value")
+	if err := SetContentHash(unchanged); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.UpdateWithCurrent(ctx, live, unchanged); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := configMap("changed")
+	if err := SetContentHash(changed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.UpdateWithCurrent(ctx, live, changed); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.ToFloat64(c.metrics.updates.WithLabelValues("", "skipped")); n != 1 {
+		t.Fatalf("expected 1 skipped update, got %v", n)
+	}
+	if n := testutil.ToFloat64(c.metrics.updates.WithLabelValues("", "applied")); n != 1 {
+		t.Fatalf("expected 1 applied update, got %v", n)
+	}
+}
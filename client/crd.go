@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+var customResourceDefinitionGroupKind = schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}
+
+// crdResourceInterface resets the discovery cache whenever a
+// CustomResourceDefinition is changed, so that the kinds it defines are
+// discovered.
+type crdResourceInterface struct {
+	dynamic.ResourceInterface
+	reset func()
+}
+
+func (c *crdResourceInterface) Create(ctx context.Context, obj *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	defer c.reset()
+	return c.ResourceInterface.Create(ctx, obj, options, subresources...)
+}
+
+func (c *crdResourceInterface) Update(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	defer c.reset()
+	return c.ResourceInterface.Update(ctx, obj, options, subresources...)
+}
+
+func (c *crdResourceInterface) Delete(ctx context.Context, name string, options metav1.DeleteOptions, subresources ...string) error {
+	defer c.reset()
+	return c.ResourceInterface.Delete(ctx, name, options, subresources...)
+}
+
+func (c *crdResourceInterface) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, options metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	defer c.reset()
+	return c.ResourceInterface.Patch(ctx, name, pt, data, options, subresources...)
+}
+
+func (c *crdResourceInterface) Apply(ctx context.Context, name string, obj *unstructured.Unstructured, options metav1.ApplyOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	defer c.reset()
+	return c.ResourceInterface.Apply(ctx, name, obj, options, subresources...)
+}
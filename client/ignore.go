@@ -0,0 +1,577 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// IgnoreDifferences is an UpdatePreparation that keeps fields of objects of
+// a kind as they are in the cluster, for fields owned by other controllers,
+// such as spec.replicas of a Deployment scaled by a HorizontalPodAutoscaler.
+// On update, the fields are copied from the current object, and removed from
+// the updated object if the current object doesn't have them.
+type IgnoreDifferences struct {
+	// Group and Kind select the objects the fields are ignored of, Group
+	// is empty for the core API group.
+	Group string
+	Kind  string
+	// JSONPointers are RFC 6901 JSON pointers, for example /spec/replicas.
+	JSONPointers []string
+	// JSONPaths are JSONPath expressions, for example
+	// .webhooks[*].clientConfig.caBundle. Fields, indexes, slices, unions,
+	// wildcards and filters comparing with == or != are supported. List
+	// elements selected by wildcards and filters are paired by their merge
+	// key, or their name for kinds unknown to client-go, and are left
+	// untouched if they only exist in either object.
+	JSONPaths []string
+}
+
+// Validate returns an error if any of the expressions is invalid.
+func (d *IgnoreDifferences) Validate() error {
+	if d.Kind == "" {
+		return fmt.Errorf("ignoreDifferences: kind must be set")
+	}
+	for _, p := range d.JSONPointers {
+		if _, err := parseJSONPointer(p); err != nil {
+			return err
+		}
+	}
+	for _, p := range d.JSONPaths {
+		if _, err := parseJSONPath(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *IgnoreDifferences) matches(u *unstructured.Unstructured) bool {
+	gvk := u.GroupVersionKind()
+	return gvk.Group == d.Group && gvk.Kind == d.Kind
+}
+
+func (d *IgnoreDifferences) Prepare(current, updated *unstructured.Unstructured) error {
+	if !d.matches(updated) {
+		return nil
+	}
+
+	for _, p := range d.JSONPointers {
+		path, err := parseJSONPointer(p)
+		if err != nil {
+			return err
+		}
+		value, found := lookupPath(current.Object, path)
+		if !found {
+			removePath(updated.Object, path)
+			continue
+		}
+		setPath(updated.Object, path, value)
+	}
+
+	var meta strategicpatch.LookupPatchMeta
+	if obj, err := scheme.Scheme.New(updated.GroupVersionKind()); err == nil {
+		if m, err := strategicpatch.NewPatchMetaFromStruct(obj); err == nil {
+			meta = m
+		}
+	}
+	for _, p := range d.JSONPaths {
+		nodes, err := parseJSONPath(p)
+		if err != nil {
+			return err
+		}
+		found, err := evalNodes(nodes, []pairedLocation{{
+			current:      location{value: current.Object},
+			updated:      location{value: updated.Object},
+			currentFound: true,
+			updatedFound: true,
+			meta:         meta,
+		}})
+		if err != nil {
+			return fmt.Errorf("evaluating JSONPath %q: %w", p, err)
+		}
+		for _, l := range found {
+			if l.currentFound {
+				setPath(updated.Object, l.updated.path, l.current.value)
+			} else if l.updatedFound {
+				removePath(updated.Object, l.updated.path)
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseJSONPointer(p string) ([]string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q: must start with /", p)
+	}
+	path := strings.Split(p[1:], "/")
+	for i, s := range path {
+		path[i] = strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+	}
+	return path, nil
+}
+
+func parseJSONPath(p string) ([]jsonpath.Node, error) {
+	text := p
+	if !strings.HasPrefix(text, "{") {
+		text = "{" + text + "}"
+	}
+	parser, err := jsonpath.Parse("ignoreDifferences", text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSONPath %q: %w", p, err)
+	}
+	if len(parser.Root.Nodes) != 1 {
+		return nil, fmt.Errorf("invalid JSONPath %q: must be a single expression", p)
+	}
+	// Evaluate against an empty object to reject unsupported expressions
+	// up front.
+	if _, err := evalNodes(parser.Root.Nodes, []pairedLocation{{current: location{value: map[string]interface{}{}}, currentFound: true}}); err != nil {
+		return nil, fmt.Errorf("invalid JSONPath %q: %w", p, err)
+	}
+	return parser.Root.Nodes, nil
+}
+
+// location is a value found by a JSONPath and the path to it.
+type location struct {
+	path  []string
+	value interface{}
+}
+
+// pairedLocation is a field selected by a JSONPath in the current and the
+// updated object. The elements of lists selected by wildcards, slices and
+// filters are paired by their merge key rather than their position, as the
+// lists may be ordered differently. The merge key is taken from the schema of
+// kinds known to client-go, other kinds are paired by the name field.
+// Elements that only exist in either of the lists are not selected.
+type pairedLocation struct {
+	current, updated           location
+	currentFound, updatedFound bool
+	// meta describes the schema of the field, nil for unknown kinds.
+	meta strategicpatch.LookupPatchMeta
+	// mergeKey is the merge key of the field's elements, if it is a list.
+	mergeKey string
+}
+
+func evalNodes(nodes []jsonpath.Node, locs []pairedLocation) ([]pairedLocation, error) {
+	for _, n := range nodes {
+		var err error
+		if locs, err = evalNode(n, locs); err != nil {
+			return nil, err
+		}
+	}
+	return locs, nil
+}
+
+func evalNode(n jsonpath.Node, locs []pairedLocation) ([]pairedLocation, error) {
+	result := []pairedLocation{}
+	switch n := n.(type) {
+	case *jsonpath.ListNode:
+		return evalNodes(n.Nodes, locs)
+	case *jsonpath.FieldNode:
+		if n.Value == "" {
+			return locs, nil
+		}
+		for _, l := range locs {
+			if child, ok := l.field(n.Value); ok {
+				result = append(result, child)
+			}
+		}
+	case *jsonpath.ArrayNode:
+		for _, l := range locs {
+			cur, curOK := l.currentList()
+			upd, updOK := l.updatedList()
+			if !curOK && !updOK {
+				continue
+			}
+			if !n.Params[0].Known && !n.Params[1].Known && !n.Params[2].Known {
+				result = append(result, l.pairElements(allIndexes(cur), allIndexes(upd))...)
+				continue
+			}
+			// Explicit indexes select elements by position on purpose.
+			seen := map[int]bool{}
+			for _, i := range append(arrayIndexes(n.Params, len(cur)), arrayIndexes(n.Params, len(upd))...) {
+				if seen[i] {
+					continue
+				}
+				seen[i] = true
+				if child, ok := l.field(strconv.Itoa(i)); ok {
+					result = append(result, child)
+				}
+			}
+		}
+	case *jsonpath.WildcardNode:
+		for _, l := range locs {
+			cur, curOK := l.currentList()
+			upd, updOK := l.updatedList()
+			if curOK || updOK {
+				result = append(result, l.pairElements(allIndexes(cur), allIndexes(upd))...)
+				continue
+			}
+			keys := map[string]bool{}
+			for _, v := range []interface{}{l.current.value, l.updated.value} {
+				if m, ok := v.(map[string]interface{}); ok {
+					for k := range m {
+						keys[k] = true
+					}
+				}
+			}
+			sorted := make([]string, 0, len(keys))
+			for k := range keys {
+				sorted = append(sorted, k)
+			}
+			sort.Strings(sorted)
+			for _, k := range sorted {
+				if child, ok := l.field(k); ok {
+					result = append(result, child)
+				}
+			}
+		}
+	case *jsonpath.UnionNode:
+		for _, list := range n.Nodes {
+			found, err := evalNodes(list.Nodes, locs)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, found...)
+		}
+	case *jsonpath.FilterNode:
+		for _, l := range locs {
+			cur, _ := l.currentList()
+			upd, _ := l.updatedList()
+			curIdx, err := filterIndexes(n, cur)
+			if err != nil {
+				return nil, err
+			}
+			updIdx, err := filterIndexes(n, upd)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, l.pairElements(curIdx, updIdx)...)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JSONPath expression %s", n)
+	}
+
+	return result, nil
+}
+
+// field returns the child of the location, which is found if it exists in
+// either of the objects.
+func (l pairedLocation) field(key string) (pairedLocation, bool) {
+	cur, curOK := childValue(l.current.value, l.currentFound, key)
+	upd, updOK := childValue(l.updated.value, l.updatedFound, key)
+	child := pairedLocation{
+		current:      l.current.child(key, cur),
+		updated:      l.updated.child(key, upd),
+		currentFound: curOK,
+		updatedFound: updOK,
+	}
+	if l.meta != nil {
+		if _, isList := cur.([]interface{}); isList {
+			child.meta, child.mergeKey = lookupSliceMeta(l.meta, key)
+		} else if _, isList := upd.([]interface{}); isList {
+			child.meta, child.mergeKey = lookupSliceMeta(l.meta, key)
+		} else if _, err := strconv.Atoi(key); err != nil {
+			child.meta, _, _ = l.meta.LookupPatchMetadataForStruct(key)
+		} else {
+			// Elements of a list share the list's element schema.
+			child.meta = l.meta
+		}
+	}
+	return child, curOK || updOK
+}
+
+func lookupSliceMeta(meta strategicpatch.LookupPatchMeta, key string) (strategicpatch.LookupPatchMeta, string) {
+	elem, patchMeta, err := meta.LookupPatchMetadataForSlice(key)
+	if err != nil {
+		return nil, ""
+	}
+	return elem, patchMeta.GetPatchMergeKey()
+}
+
+func childValue(value interface{}, found bool, key string) (interface{}, bool) {
+	if !found {
+		return nil, false
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, ok := v[key]
+		return child, ok
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, false
+		}
+		return v[i], true
+	}
+	return nil, false
+}
+
+func (l pairedLocation) currentList() ([]interface{}, bool) {
+	s, ok := l.current.value.([]interface{})
+	return s, ok && l.currentFound
+}
+
+func (l pairedLocation) updatedList() ([]interface{}, bool) {
+	s, ok := l.updated.value.([]interface{})
+	return s, ok && l.updatedFound
+}
+
+// pairElements pairs the selected elements of the current and updated list
+// by their merge key. Without a merge key, elements are only paired if a
+// single element is selected in each list.
+func (l pairedLocation) pairElements(curIdx, updIdx []int) []pairedLocation {
+	cur, _ := l.currentList()
+	upd, _ := l.updatedList()
+	mergeKey := l.mergeKey
+	if mergeKey == "" && l.meta == nil {
+		mergeKey = "name"
+	}
+
+	pair := func(ci, ui int) pairedLocation {
+		return pairedLocation{
+			current:      l.current.child(strconv.Itoa(ci), cur[ci]),
+			updated:      l.updated.child(strconv.Itoa(ui), upd[ui]),
+			currentFound: true,
+			updatedFound: true,
+			meta:         l.meta,
+		}
+	}
+
+	result := []pairedLocation{}
+	if mergeKey != "" {
+		byKey := map[string]int{}
+		for _, ci := range curIdx {
+			if k, ok := elementKey(cur[ci], mergeKey); ok {
+				if _, dup := byKey[k]; !dup {
+					byKey[k] = ci
+				}
+			}
+		}
+		for _, ui := range updIdx {
+			k, ok := elementKey(upd[ui], mergeKey)
+			if !ok {
+				continue
+			}
+			if ci, ok := byKey[k]; ok {
+				result = append(result, pair(ci, ui))
+			}
+		}
+		if len(result) > 0 {
+			return result
+		}
+	}
+	if len(curIdx) == 1 && len(updIdx) == 1 {
+		result = append(result, pair(curIdx[0], updIdx[0]))
+	}
+	return result
+}
+
+func elementKey(elem interface{}, mergeKey string) (string, bool) {
+	m, ok := elem.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	v, ok := m[mergeKey]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+func allIndexes(s []interface{}) []int {
+	indexes := make([]int, len(s))
+	for i := range s {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+// arrayIndexes returns the indexes an array slice selects, out of range
+// slices select nothing.
+func arrayIndexes(params [3]jsonpath.ParamsEntry, length int) []int {
+	start, end, step := 0, length, 1
+	if params[0].Known {
+		start = params[0].Value
+		if start < 0 {
+			start += length
+		}
+	}
+	if params[1].Known {
+		end = params[1].Value
+		if end < 0 || (end == 0 && params[1].Derived) {
+			end += length
+		}
+	}
+	if params[2].Known && params[2].Value > 0 {
+		step = params[2].Value
+	}
+	if start < 0 || end > length || start >= end {
+		return nil
+	}
+
+	indexes := []int{}
+	for i := start; i < end; i += step {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// filterIndexes returns the indexes of the list's elements the filter
+// matches.
+func filterIndexes(n *jsonpath.FilterNode, list []interface{}) ([]int, error) {
+	indexes := []int{}
+	for i := range list {
+		match, err := evalFilter(n, list[i])
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+func evalFilter(n *jsonpath.FilterNode, value interface{}) (bool, error) {
+	lefts, err := evalValues(n.Left.Nodes, value)
+	if err != nil {
+		return false, err
+	}
+	if n.Operator == "exists" {
+		return len(lefts) > 0, nil
+	}
+	if n.Operator != "==" && n.Operator != "!=" {
+		return false, fmt.Errorf("unsupported filter operator %s", n.Operator)
+	}
+	if len(lefts) != 1 {
+		return false, nil
+	}
+
+	right, err := filterOperand(n.Right, value)
+	if err != nil {
+		return false, err
+	}
+	equal := fmt.Sprint(lefts[0]) == fmt.Sprint(right)
+	return equal == (n.Operator == "=="), nil
+}
+
+func filterOperand(list *jsonpath.ListNode, value interface{}) (interface{}, error) {
+	if len(list.Nodes) == 1 {
+		switch n := list.Nodes[0].(type) {
+		case *jsonpath.TextNode:
+			return n.Text, nil
+		case *jsonpath.IntNode:
+			return n.Value, nil
+		case *jsonpath.FloatNode:
+			return n.Value, nil
+		case *jsonpath.BoolNode:
+			return n.Value, nil
+		}
+	}
+	values, err := evalValues(list.Nodes, value)
+	if err != nil || len(values) != 1 {
+		return nil, err
+	}
+	return values[0], nil
+}
+
+// evalValues returns the values the JSONPath selects in a single value.
+func evalValues(nodes []jsonpath.Node, value interface{}) ([]interface{}, error) {
+	locs, err := evalNodes(nodes, []pairedLocation{{current: location{value: value}, currentFound: true}})
+	if err != nil {
+		return nil, err
+	}
+	values := []interface{}{}
+	for _, l := range locs {
+		if l.currentFound {
+			values = append(values, l.current.value)
+		}
+	}
+	return values, nil
+}
+
+func (l location) child(segment string, value interface{}) location {
+	path := make([]string, len(l.path), len(l.path)+1)
+	copy(path, l.path)
+	return location{path: append(path, segment), value: value}
+}
+
+func lookupPath(obj interface{}, path []string) (interface{}, bool) {
+	for _, segment := range path {
+		switch v := obj.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if obj, ok = v[segment]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			obj = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return obj, true
+}
+
+// setPath sets the value at the path, creating missing objects on the way.
+// Missing list elements are not created, the value is not set then.
+func setPath(obj map[string]interface{}, path []string, value interface{}) {
+	var parent interface{} = obj
+	for i, segment := range path {
+		last := i == len(path)-1
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			if last {
+				v[segment] = runtime.DeepCopyJSONValue(value)
+				return
+			}
+			next, ok := v[segment]
+			if !ok {
+				next = map[string]interface{}{}
+				v[segment] = next
+			}
+			parent = next
+		case []interface{}:
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return
+			}
+			if last {
+				v[idx] = runtime.DeepCopyJSONValue(value)
+				return
+			}
+			parent = v[idx]
+		default:
+			return
+		}
+	}
+}
+
+// removePath removes the field at the path. List elements are not removed,
+// as that would shift the following elements.
+func removePath(obj map[string]interface{}, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	parent, found := lookupPath(obj, path[:len(path)-1])
+	if !found {
+		return
+	}
+	if m, ok := parent.(map[string]interface{}); ok {
+		delete(m, path[len(path)-1])
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestIgnoreDifferences(t *testing.T) {
+	webhook := func(caBundle string) map[string]interface{} {
+		clientConfig := map[string]interface{}{"url": "https://example.com"}
+		if caBundle != "" {
+			clientConfig["caBundle"] = caBundle
+		}
+		return map[string]interface{}{"name": "hook", "clientConfig": clientConfig}
+	}
+	object := func(replicas int64, image, caBundle string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"spec": map[string]interface{}{
+				"replicas": replicas,
+				"template": map[string]interface{}{"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "app", "image": image},
+						map[string]interface{}{"name": "sidecar", "image": image},
+					},
+				}},
+			},
+			"webhooks": []interface{}{webhook(caBundle)},
+		}}
+	}
+
+	d := &IgnoreDifferences{
+		Group:        "apps",
+		Kind:         "Deployment",
+		JSONPointers: []string{"/spec/replicas"},
+		JSONPaths: []string{
+			`.spec.template.spec.containers[?(@.name=="sidecar")].image`,
+			".webhooks[*].clientConfig.caBundle",
+		},
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	current := object(5, "live", "")
+	updated := object(1, "rendered", "injected")
+	if err := d.Prepare(current, updated); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := object(5, "rendered", "")
+	// Only the sidecar's image is ignored.
+	unstructured.SetNestedSlice(expected.Object, []interface{}{
+		map[string]interface{}{"name": "app", "image": "rendered"},
+		map[string]interface{}{"name": "sidecar", "image": "live"},
+	}, "spec", "template", "spec", "containers")
+	if !reflect.DeepEqual(updated.Object, expected.Object) {
+		t.Fatalf("expected %v, got %v", expected.Object, updated.Object)
+	}
+
+	other := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "Service", "spec": map[string]interface{}{"replicas": int64(1)}}}
+	if err := d.Prepare(current, other); err != nil {
+		t.Fatal(err)
+	}
+	if other.Object["spec"].(map[string]interface{})["replicas"] != int64(1) {
+		t.Fatal("expected other kinds to be left untouched")
+	}
+
+	for _, invalid := range []*IgnoreDifferences{
+		{Kind: "Deployment", JSONPointers: []string{"spec/replicas"}},
+		{Kind: "Deployment", JSONPaths: []string{"..image"}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("expected %v to be invalid", invalid)
+		}
+	}
+}
+
+func TestIgnoreDifferencesPairsListElements(t *testing.T) {
+	containers := func(u *unstructured.Unstructured) []interface{} {
+		c, _, _ := unstructured.NestedSlice(u.Object, "spec", "template", "spec", "containers")
+		return c
+	}
+	object := func(apiVersion, kind string, containers ...map[string]interface{}) *unstructured.Unstructured {
+		list := []interface{}{}
+		for _, c := range containers {
+			list = append(list, c)
+		}
+		u := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": apiVersion, "kind": kind}}
+		unstructured.SetNestedSlice(u.Object, list, "spec", "template", "spec", "containers")
+		return u
+	}
+	container := func(name, image string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "image": image}
+	}
+
+	for _, gvk := range [][2]string{{"apps/v1", "Deployment"}, {"example.com/v1", "Widget"}} {
+		for _, path := range []string{
+			`.spec.template.spec.containers[?(@.name=="sidecar")].image`,
+			`.spec.template.spec.containers[*].image`,
+		} {
+			group := "apps"
+			if gvk[1] == "Widget" {
+				group = "example.com"
+			}
+			d := &IgnoreDifferences{Group: group, Kind: gvk[1], JSONPaths: []string{path}}
+
+			current := object(gvk[0], gvk[1], container("sidecar", "sidecar:live"), container("app", "app:live"))
+			updated := object(gvk[0], gvk[1], container("app", "app:rendered"), container("sidecar", "sidecar:rendered"), container("new", "new:rendered"))
+			if err := d.Prepare(current, updated); err != nil {
+				t.Fatal(err)
+			}
+
+			appImage := "app:rendered"
+			if path == `.spec.template.spec.containers[*].image` {
+				appImage = "app:live"
+			}
+			expected := []interface{}{container("app", appImage), container("sidecar", "sidecar:live"), container("new", "new:rendered")}
+			if !reflect.DeepEqual(containers(updated), expected) {
+				t.Fatalf("%s %s: expected containers %v, got %v", gvk[1], path, expected, containers(updated))
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/discovery"
+)
+
+// UnknownKindError is returned when the API server doesn't serve a kind.
+type UnknownKindError struct {
+	APIVersion string
+	Kind       string
+	// Similar lists kinds served by the API server with a similar name, as
+	// "Kind in apiVersion".
+	Similar []string
+}
+
+func (e *UnknownKindError) Error() string {
+	msg := fmt.Sprintf("kind %s in %s is not served by the API server", e.Kind, e.APIVersion)
+	if len(e.Similar) > 0 {
+		msg += ", similar kinds: " + strings.Join(e.Similar, ", ")
+	}
+	return msg
+}
+
+// similarKinds returns the kinds served by the API server whose name equals
+// or contains the kind, or is contained in it, ignoring case.
+func similarKinds(d discovery.DiscoveryInterface, apiVersion, kind string) []string {
+	// Partial results are good enough for suggestions.
+	_, lists, _ := d.ServerGroupsAndResources()
+
+	kind = strings.ToLower(kind)
+	seen := map[string]struct{}{}
+	similar := []string{}
+	for _, list := range lists {
+		for _, r := range list.APIResources {
+			if strings.Contains(r.Name, "/") {
+				// Subresources share the kind of their resource.
+				continue
+			}
+			k := strings.ToLower(r.Kind)
+			if !strings.Contains(k, kind) && !strings.Contains(kind, k) {
+				continue
+			}
+			if list.GroupVersion == apiVersion && k == kind {
+				continue
+			}
+			s := r.Kind + " in " + list.GroupVersion
+			if _, ok := seen[s]; ok {
+				continue
+			}
+			seen[s] = struct{}{}
+			similar = append(similar, s)
+		}
+	}
+	sort.Strings(similar)
+
+	return similar
+}
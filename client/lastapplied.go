@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const (
+	// LastAppliedAnnotation holds the object as it was last applied with the
+	// three-way merge update strategy.
+	LastAppliedAnnotation = "locutus.io/last-applied-configuration"
+)
+
+// UpdateStrategy is how ResourceClient.UpdateWithCurrent updates objects.
+type UpdateStrategy string
+
+const (
+	// UpdateStrategyReplace replaces the whole object. Fields set by others
+	// are lost, unless an UpdatePreparation copies them.
+	UpdateStrategyReplace UpdateStrategy = "Replace"
+	// UpdateStrategyThreeWayMerge patches the object with the difference
+	// between the object as it was last applied, the live object and the
+	// updated object, the way kubectl apply does. Fields removed since the
+	// object was last applied are deleted, fields set by others are kept.
+	UpdateStrategyThreeWayMerge UpdateStrategy = "ThreeWayMerge"
+)
+
+var UpdateStrategies = []UpdateStrategy{
+	UpdateStrategyReplace,
+	UpdateStrategyThreeWayMerge,
+}
+
+// CreateObject creates the object. With the three-way merge update strategy,
+// the object is recorded as last applied.
+func (rc *ResourceClient) CreateObject(ctx context.Context, u *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	if rc.updateStrategy == UpdateStrategyThreeWayMerge {
+		if err := setLastApplied(u); err != nil {
+			return nil, err
+		}
+	}
+
+	return rc.ResourceInterface.Create(ctx, u, v1.CreateOptions{})
+}
+
+// threeWayMergeUpdate patches the current object into the updated one. The
+// patch is computed as a strategic merge patch for kinds known to client-go,
+// and as a JSON merge patch for others, such as custom resources.
+func (rc *ResourceClient) threeWayMergeUpdate(ctx context.Context, current, updated *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	// The last applied object is recorded as given, before fields are
+	// copied from the current object.
+	lastApplied, err := lastAppliedConfiguration(updated)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rc.prepareUnstructuredForUpdate(current, updated); err != nil {
+		return nil, err
+	}
+	setAnnotation(updated, LastAppliedAnnotation, string(lastApplied))
+
+	needUpdate, err := rc.checkUnstructuredForUpdate(current, updated)
+	if err != nil {
+		return nil, err
+	}
+	if !needUpdate {
+		rc.countUpdate("skipped")
+		return nil, nil
+	}
+
+	var original []byte
+	if a, ok := current.GetAnnotations()[LastAppliedAnnotation]; ok {
+		original = []byte(a)
+	}
+	modified, err := json.Marshal(updated.Object)
+	if err != nil {
+		return nil, err
+	}
+	live, err := json.Marshal(current.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		patch     []byte
+		patchType types.PatchType
+	)
+	obj, err := scheme.Scheme.New(updated.GroupVersionKind())
+	switch {
+	case err == nil:
+		meta, err := strategicpatch.NewPatchMetaFromStruct(obj)
+		if err != nil {
+			return nil, err
+		}
+		patchType = types.StrategicMergePatchType
+		patch, err = strategicpatch.CreateThreeWayMergePatch(original, modified, live, meta, true)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating strategic merge patch failed")
+		}
+	case runtime.IsNotRegisteredError(err):
+		patchType = types.MergePatchType
+		patch, err = jsonmergepatch.CreateThreeWayJSONMergePatch(original, modified, live)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating JSON merge patch failed")
+		}
+	default:
+		return nil, err
+	}
+
+	if string(patch) == "{}" {
+		rc.countUpdate("skipped")
+		return nil, nil
+	}
+
+	u, err := rc.ResourceInterface.Patch(ctx, updated.GetName(), patchType, patch, v1.PatchOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rc.countUpdate("applied")
+
+	return u, nil
+}
+
+// lastAppliedConfiguration returns the object as recorded in the last applied
+// annotation, without the annotation itself.
+func lastAppliedConfiguration(u *unstructured.Unstructured) ([]byte, error) {
+	u = u.DeepCopy()
+	unstructured.RemoveNestedField(u.Object, "metadata", "annotations", LastAppliedAnnotation)
+	if annotations, found, _ := unstructured.NestedMap(u.Object, "metadata", "annotations"); found && len(annotations) == 0 {
+		unstructured.RemoveNestedField(u.Object, "metadata", "annotations")
+	}
+
+	b, err := json.Marshal(u.Object)
+	if err != nil {
+		return nil, fmt.Errorf("marshal last applied configuration: %w", err)
+	}
+	return b, nil
+}
+
+func setLastApplied(u *unstructured.Unstructured) error {
+	lastApplied, err := lastAppliedConfiguration(u)
+	if err != nil {
+		return err
+	}
+	setAnnotation(u, LastAppliedAnnotation, string(lastApplied))
+	return nil
+}
+
+func setAnnotation(u *unstructured.Unstructured, key, value string) {
+	annotations := u.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[key] = value
+	u.SetAnnotations(annotations)
+}
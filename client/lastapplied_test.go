@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func widget(spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"metadata": map[string]interface{}{
+			"name":      "test",
+			"namespace": "default",
+		},
+		"spec": spec,
+	}}
+}
+
+func TestThreeWayMergeUpdate(t *testing.T) {
+	ctx := context.Background()
+	gvr := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{gvr: "WidgetList"})
+	rc := &ResourceClient{
+		ResourceInterface: dc.Resource(gvr).Namespace("default"),
+		updateStrategy:    UpdateStrategyThreeWayMerge,
+	}
+
+	if _, err := rc.CreateObject(ctx, widget(map[string]interface{}{"size": "small", "color": "red"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else sets a field.
+	live, err := rc.Get(ctx, "test", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unstructured.SetNestedField(live.Object, "foreign", "spec", "owner")
+	if live, err = rc.Update(ctx, live, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The color is removed from the rendered object.
+	if _, err := rc.UpdateWithCurrent(ctx, live, widget(map[string]interface{}{"size": "large"})); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := rc.Get(ctx, "test", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"size": "large", "owner": "foreign"}
+	if !reflect.DeepEqual(result.Object["spec"], expected) {
+		t.Fatalf("expected spec %v, got %v", expected, result.Object["spec"])
+	}
+	if result.GetAnnotations()[LastAppliedAnnotation] != `{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"test","namespace":"default"},"spec":{"size":"large"}}` {
+		t.Fatalf("unexpected last applied configuration %s", result.GetAnnotations()[LastAppliedAnnotation])
+	}
+}
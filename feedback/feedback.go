@@ -3,6 +3,7 @@ package feedback
 import (
 	"context"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/brancz/locutus/client"
@@ -21,6 +22,9 @@ type StatusCondition struct {
 	LastTransitionTime metav1.Time   `json:"lastTransitionTime"`
 	Name               string        `json:"name"`
 	CurrentStatus      CurrentStatus `json:"currentStatus"`
+	// Message gives details on the current status, such as who approved a
+	// gate.
+	Message string `json:"message,omitempty"`
 }
 
 type CurrentStatus string
@@ -29,6 +33,8 @@ const (
 	StatusConditionNotStarted CurrentStatus = "Not Started"
 	StatusConditionInProgress CurrentStatus = "In Progress"
 	StatusConditionFinished   CurrentStatus = "Finished"
+	StatusConditionFailed     CurrentStatus = "Failed"
+	StatusConditionSkipped    CurrentStatus = "Skipped"
 )
 
 func extractStatus(u *unstructured.Unstructured) *Status {
@@ -70,6 +76,7 @@ func extractStatusCondition(v map[string]interface{}) *StatusCondition {
 	return &StatusCondition{
 		Name:               getNestedString(v, "name"),
 		CurrentStatus:      CurrentStatus(getNestedString(v, "currentStatus")),
+		Message:            getNestedString(v, "message"),
 		LastTransitionTime: t,
 	}
 }
@@ -77,9 +84,13 @@ func extractStatusCondition(v map[string]interface{}) *StatusCondition {
 type Feedback interface {
 	Initialize(ctx context.Context, groups []string) error
 	SetCondition(ctx context.Context, name string, currentStatus CurrentStatus) error
+	SetConditionMessage(ctx context.Context, name string, currentStatus CurrentStatus, message string) error
 }
 
 type feedback struct {
+	// mtx guards the status, as groups may finish concurrently.
+	mtx sync.Mutex
+
 	logger        log.Logger
 	client        *client.Client
 	oldStatus     *Status
@@ -99,24 +110,47 @@ func NewFeedback(logger log.Logger, client *client.Client, u *unstructured.Unstr
 }
 
 func (f *feedback) Initialize(ctx context.Context, groups []string) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	level.Debug(f.logger).Log("msg", "initializing status", "namespace", f.obj.GetNamespace(), "name", f.obj.GetName(), "kind", f.obj.GetKind(), "apiVersion", f.obj.GetAPIVersion())
 	f.initializeStatus(groups)
 	return f.updateStatus(ctx)
 }
 
 func (f *feedback) SetCondition(ctx context.Context, name string, currentStatus CurrentStatus) error {
+	return f.SetConditionMessage(ctx, name, currentStatus, "")
+}
+
+func (f *feedback) SetConditionMessage(ctx context.Context, name string, currentStatus CurrentStatus, message string) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	level.Debug(f.logger).Log("msg", "setting condition status", "namespace", f.obj.GetNamespace(), "name", f.obj.GetName(), "kind", f.obj.GetKind(), "apiVersion", f.obj.GetAPIVersion(), "condition", name, "status", currentStatus)
+	found := false
 	for i, c := range f.currentStatus.Conditions {
 		if c.Name == name {
-			if c.CurrentStatus != currentStatus {
+			found = true
+			if c.CurrentStatus != currentStatus || c.Message != message {
 				f.currentStatus.Conditions[i] = &StatusCondition{
 					Name:               name,
 					CurrentStatus:      currentStatus,
+					Message:            message,
 					LastTransitionTime: metav1.Now(),
 				}
 			}
 		}
 	}
+	// Conditions of anything other than groups, such as canaries, are
+	// added as they are first reported.
+	if !found {
+		f.currentStatus.Conditions = append(f.currentStatus.Conditions, &StatusCondition{
+			Name:               name,
+			CurrentStatus:      currentStatus,
+			Message:            message,
+			LastTransitionTime: metav1.Now(),
+		})
+	}
 
 	return f.updateStatus(ctx)
 }
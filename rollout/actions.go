@@ -2,12 +2,26 @@ package rollout
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 
+	"github.com/go-kit/kit/log"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apitypes "k8s.io/apimachinery/pkg/types"
 
 	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/feedback"
+	"github.com/brancz/locutus/rollout/checks"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+const (
+	DefaultFieldManager = "locutus"
 )
 
 var (
@@ -15,6 +29,12 @@ var (
 		&CreateOrUpdateObjectAction{},
 		&CreateIfNotExistObjectAction{},
 		&DeleteIfExistsObjectAction{},
+		&ApplyObjectAction{FieldManager: DefaultFieldManager},
+		&CanaryObjectAction{Replicas: DefaultCanaryReplicas},
+		&BlueGreenObjectAction{DeleteDelay: DefaultBlueGreenDeleteDelay},
+		&PatchObjectAction{PatchType: apitypes.JSONPatchType},
+		&PatchObjectAction{PatchType: apitypes.MergePatchType},
+		&PatchObjectAction{PatchType: apitypes.StrategicMergePatchType},
 	}
 )
 
@@ -23,12 +43,71 @@ type ObjectAction interface {
 	Name() string
 }
 
+// StepObjectAction is implemented by actions that need to know about the step
+// they are executed for, for example to run its success checks themselves.
+// The runner calls ExecuteStep instead of Execute for them, Execute is only
+// used where there is no step, such as in dry runs of actions that don't
+// implement DryRunStepObjectAction.
+type StepObjectAction interface {
+	ObjectAction
+	ExecuteStep(context.Context, *StepContext, *client.ResourceClient, *unstructured.Unstructured) error
+}
+
+// DryRunFunc runs the change of the object as a server-side dry run, and
+// reports the difference between the live object and the result. The change
+// must only use the given ResourceClient.
+type DryRunFunc func(rc *client.ResourceClient, u *unstructured.Unstructured, change func(*client.ResourceClient) error) error
+
+// DryRunStepObjectAction is implemented by StepObjectActions whose Execute
+// can't run without a step. In server-side dry runs DryRunStep is called
+// instead, and must make every change it would make through dryRun.
+type DryRunStepObjectAction interface {
+	StepObjectAction
+	DryRunStep(ctx context.Context, s *StepContext, rc *client.ResourceClient, u *unstructured.Unstructured, dryRun DryRunFunc) error
+}
+
+// StepContext describes the step a StepObjectAction is executed for.
+type StepContext struct {
+	Logger log.Logger
+	Group  string
+	Step   *types.Step
+	Client *client.Client
+	Checks *checks.Checks
+	// Feedback is nil if no feedback is to be given.
+	Feedback feedback.Feedback
+
+	// journal is nil if the rollout isn't rolled back on failure.
+	journal *rollbackJournal
+	cluster string
+}
+
+// snapshot records the live state of an object the action changes besides
+// the step's object, so that it is restored should the rollout be rolled
+// back.
+func (s *StepContext) snapshot(ctx context.Context, rc *client.ResourceClient, u *unstructured.Unstructured) error {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.snapshot(ctx, s.cluster, rc, u)
+}
+
+func (s *StepContext) setCondition(ctx context.Context, name string, status feedback.CurrentStatus) error {
+	if s.Feedback == nil {
+		return nil
+	}
+	return s.Feedback.SetCondition(ctx, name, status)
+}
+
 type CreateOrUpdateObjectAction struct{}
 
 func (a *CreateOrUpdateObjectAction) Execute(ctx context.Context, rc *client.ResourceClient, unstructured *unstructured.Unstructured) error {
+	return createOrUpdate(ctx, rc, unstructured)
+}
+
+func createOrUpdate(ctx context.Context, rc *client.ResourceClient, unstructured *unstructured.Unstructured) error {
 	current, err := rc.Get(ctx, unstructured.GetName(), metav1.GetOptions{})
 	if apierrors.IsNotFound(err) {
-		_, err := rc.Create(ctx, unstructured, metav1.CreateOptions{})
+		_, err := rc.CreateObject(ctx, unstructured)
 		return err
 	}
 	if err != nil {
@@ -48,7 +127,7 @@ type CreateIfNotExistObjectAction struct{}
 func (a *CreateIfNotExistObjectAction) Execute(ctx context.Context, rc *client.ResourceClient, unstructured *unstructured.Unstructured) error {
 	_, err := rc.Get(ctx, unstructured.GetName(), metav1.GetOptions{})
 	if apierrors.IsNotFound(err) {
-		_, err := rc.Create(ctx, unstructured, metav1.CreateOptions{})
+		_, err := rc.CreateObject(ctx, unstructured)
 		return err
 	}
 	if err != nil {
@@ -65,8 +144,12 @@ func (a *CreateIfNotExistObjectAction) Name() string {
 type DeleteIfExistsObjectAction struct{}
 
 func (a *DeleteIfExistsObjectAction) Execute(ctx context.Context, rc *client.ResourceClient, unstructured *unstructured.Unstructured) error {
+	return deleteIfExists(ctx, rc, unstructured.GetName())
+}
+
+func deleteIfExists(ctx context.Context, rc *client.ResourceClient, name string) error {
 	propagationPolicy := metav1.DeletePropagationForeground
-	err := rc.Delete(ctx, unstructured.GetName(), metav1.DeleteOptions{
+	err := rc.Delete(ctx, name, metav1.DeleteOptions{
 		PropagationPolicy: &propagationPolicy,
 	})
 	if apierrors.IsNotFound(err) {
@@ -82,3 +165,115 @@ func (a *DeleteIfExistsObjectAction) Execute(ctx context.Context, rc *client.Res
 func (a *DeleteIfExistsObjectAction) Name() string {
 	return "DeleteIfExist"
 }
+
+// ApplyObjectAction applies objects using server-side apply, so that fields
+// owned by other field managers, such as other controllers, are left
+// untouched.
+type ApplyObjectAction struct {
+	// FieldManager is the name of the field manager objects are applied as.
+	FieldManager string
+	// Force takes ownership of fields that are in conflict with other field
+	// managers, instead of failing.
+	Force bool
+}
+
+func (a *ApplyObjectAction) Execute(ctx context.Context, rc *client.ResourceClient, unstructured *unstructured.Unstructured) error {
+	fieldManager := a.FieldManager
+	if fieldManager == "" {
+		fieldManager = DefaultFieldManager
+	}
+
+	// Ignored fields are applied with their live values, omitting them
+	// would remove them if they were applied before.
+	if rc.HasIgnoredFields(unstructured) {
+		current, err := rc.Get(ctx, unstructured.GetName(), metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if err := rc.CopyIgnoredFields(current, unstructured); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := rc.Apply(ctx, unstructured.GetName(), unstructured, metav1.ApplyOptions{
+		FieldManager: fieldManager,
+		Force:        a.Force,
+	})
+	if apierrors.IsConflict(err) {
+		if conflictErr := newApplyConflictError(err); conflictErr != nil {
+			return conflictErr
+		}
+	}
+
+	return err
+}
+
+func (a *ApplyObjectAction) Name() string {
+	return "Apply"
+}
+
+// ApplyConflict is a field owned by another field manager.
+type ApplyConflict struct {
+	Field   string
+	Manager string
+}
+
+// ApplyConflictError is returned when applying an object failed due to
+// fields owned by other field managers.
+type ApplyConflictError struct {
+	Conflicts []ApplyConflict
+	err       error
+}
+
+var conflictManagerRegexp = regexp.MustCompile(`^conflict with ("(?:[^"\\]|\\.)*")`)
+
+// newApplyConflictError extracts the conflicting fields and their managers
+// from an apply conflict, returns nil if the error doesn't contain any.
+func newApplyConflictError(err error) *ApplyConflictError {
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) || status.Status().Details == nil {
+		return nil
+	}
+
+	conflicts := []ApplyConflict{}
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type != metav1.CauseTypeFieldManagerConflict {
+			continue
+		}
+
+		manager := cause.Message
+		if m := conflictManagerRegexp.FindStringSubmatch(cause.Message); m != nil {
+			if unquoted, err := strconv.Unquote(m[1]); err == nil {
+				manager = unquoted
+			}
+		}
+
+		conflicts = append(conflicts, ApplyConflict{
+			Field:   cause.Field,
+			Manager: manager,
+		})
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	return &ApplyConflictError{
+		Conflicts: conflicts,
+		err:       err,
+	}
+}
+
+func (e *ApplyConflictError) Error() string {
+	fields := make([]string, 0, len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		fields = append(fields, fmt.Sprintf("%s is owned by %q", c.Field, c.Manager))
+	}
+
+	return fmt.Sprintf("apply conflicts with other field managers, force the apply to take ownership: %s", strings.Join(fields, ", "))
+}
+
+func (e *ApplyConflictError) Unwrap() error {
+	return e.err
+}
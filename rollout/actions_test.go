@@ -0,0 +1,44 @@
+package rollout
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestApplyConflictError(t *testing.T) {
+	err := fmt.Errorf("apply: %w", apierrors.NewApplyConflict([]metav1.StatusCause{
+		{
+			Type:    metav1.CauseTypeFieldManagerConflict,
+			Message: `conflict with "kube-controller-manager" using apps/v1`,
+			Field:   ".spec.replicas",
+		},
+		{
+			Type:    metav1.CauseTypeFieldManagerConflict,
+			Message: `conflict with "cert-manager"`,
+			Field:   ".webhooks[name=\"test\"].clientConfig.caBundle",
+		},
+	}, "Apply failed with 2 conflicts"))
+
+	conflictErr := newApplyConflictError(err)
+	if conflictErr == nil {
+		t.Fatal("expected conflict error, got nil")
+	}
+
+	expected := `apply conflicts with other field managers, force the apply to take ownership: .spec.replicas is owned by "kube-controller-manager", .webhooks[name="test"].clientConfig.caBundle is owned by "cert-manager"`
+	if conflictErr.Error() != expected {
+		t.Fatalf("expected error:\n%s\ngot:\n%s", expected, conflictErr.Error())
+	}
+	if !apierrors.IsConflict(conflictErr) {
+		t.Fatal("expected conflict error to unwrap to the API error")
+	}
+}
+
+func TestApplyConflictErrorWithoutConflicts(t *testing.T) {
+	if err := newApplyConflictError(errors.New("test")); err != nil {
+		t.Fatalf("expected nil, got: %v", err)
+	}
+}
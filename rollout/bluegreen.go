@@ -0,0 +1,248 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/hashicorp/go-multierror"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apitypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/feedback"
+)
+
+const (
+	// ColorLabel is set on the pods of each color of a blue/green
+	// Deployment, and on the selector of the Service to switch between them.
+	ColorLabel = "locutus.io/color"
+	// BlueGreenServiceAnnotation names the Service in the Deployment's
+	// namespace, that is switched between the colors of the Deployment.
+	BlueGreenServiceAnnotation = "locutus.io/blue-green-service"
+
+	DefaultBlueGreenDeleteDelay = 30 * time.Second
+
+	colorBlue  = "blue"
+	colorGreen = "green"
+)
+
+var (
+	ErrStepRequired = errors.New("action can only be executed as part of a step")
+)
+
+// BlueGreenObjectAction rolls out a Deployment next to the currently active
+// one, under the other color (<name>-blue or <name>-green). Once the step's
+// success checks succeed for it, the Service referenced through the
+// BlueGreenServiceAnnotation is switched to the new color, and the Deployment
+// of the previous color is deleted after a delay.
+type BlueGreenObjectAction struct {
+	// DeleteDelay is how long the previous color is kept after the Service
+	// was switched to the new color.
+	DeleteDelay time.Duration
+}
+
+func (a *BlueGreenObjectAction) Name() string {
+	return "BlueGreen"
+}
+
+// Execute fails, as the color to roll out depends on the live Service, which
+// requires the step to be known.
+func (a *BlueGreenObjectAction) Execute(ctx context.Context, rc *client.ResourceClient, u *unstructured.Unstructured) error {
+	return ErrStepRequired
+}
+
+// blueGreenState is the live state a blue/green rollout of a Deployment
+// starts from.
+type blueGreenState struct {
+	service *unstructured.Unstructured
+	// src is the client of the Service.
+	src                      *client.ResourceClient
+	previousColor, nextColor string
+}
+
+// state looks up the Service of the Deployment, and the color it currently
+// selects.
+func (a *BlueGreenObjectAction) state(ctx context.Context, s *StepContext, u *unstructured.Unstructured) (*blueGreenState, error) {
+	if u.GetKind() != "Deployment" {
+		return nil, ErrNotADeployment
+	}
+
+	serviceName := u.GetAnnotations()[BlueGreenServiceAnnotation]
+	if serviceName == "" {
+		return nil, fmt.Errorf("deployment %s is missing the %s annotation", u.GetName(), BlueGreenServiceAnnotation)
+	}
+
+	svc := &unstructured.Unstructured{}
+	svc.SetAPIVersion("v1")
+	svc.SetKind("Service")
+	svc.SetNamespace(u.GetNamespace())
+	svc.SetName(serviceName)
+	src, err := s.Client.ClientForUnstructured(svc)
+	if err != nil {
+		return nil, err
+	}
+	service, err := src.Get(ctx, serviceName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get service %s: %w", serviceName, err)
+	}
+
+	previousColor, _, err := unstructured.NestedString(service.Object, "spec", "selector", ColorLabel)
+	if err != nil {
+		return nil, err
+	}
+	nextColor := colorBlue
+	if previousColor == colorBlue {
+		nextColor = colorGreen
+	}
+
+	return &blueGreenState{
+		service:       service,
+		src:           src,
+		previousColor: previousColor,
+		nextColor:     nextColor,
+	}, nil
+}
+
+// switchService switches the Service to the color.
+func switchService(ctx context.Context, src *client.ResourceClient, name, color string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"selector": map[string]interface{}{
+				ColorLabel: color,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := src.Patch(ctx, name, apitypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("switch service %s to %s: %w", name, color, err)
+	}
+	return nil
+}
+
+// DryRunStep rolls out the next color, switches the Service to it and
+// removes the previous color as dry runs, without waiting for success checks
+// or the delete delay.
+func (a *BlueGreenObjectAction) DryRunStep(ctx context.Context, s *StepContext, rc *client.ResourceClient, u *unstructured.Unstructured, dryRun DryRunFunc) error {
+	state, err := a.state(ctx, s, u)
+	if err != nil {
+		return err
+	}
+
+	next, err := colored(u, state.nextColor)
+	if err != nil {
+		return err
+	}
+	err = dryRun(rc, next, func(rc *client.ResourceClient) error {
+		return createOrUpdate(ctx, rc, next)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = dryRun(state.src, state.service, func(src *client.ResourceClient) error {
+		return switchService(ctx, src, state.service.GetName(), state.nextColor)
+	})
+	if err != nil {
+		return err
+	}
+
+	if state.previousColor == "" {
+		return nil
+	}
+	previous, err := colored(u, state.previousColor)
+	if err != nil {
+		return err
+	}
+	return dryRun(rc, previous, func(rc *client.ResourceClient) error {
+		return deleteIfExists(ctx, rc, previous.GetName())
+	})
+}
+
+func (a *BlueGreenObjectAction) ExecuteStep(ctx context.Context, s *StepContext, rc *client.ResourceClient, u *unstructured.Unstructured) error {
+	state, err := a.state(ctx, s, u)
+	if err != nil {
+		return err
+	}
+	service, src := state.service, state.src
+	previousColor, nextColor := state.previousColor, state.nextColor
+
+	next, err := colored(u, nextColor)
+	if err != nil {
+		return err
+	}
+
+	condition := "blue-green/" + u.GetName()
+	if err := s.setCondition(ctx, condition, feedback.StatusConditionInProgress); err != nil {
+		return err
+	}
+
+	if err := s.snapshot(ctx, rc, next); err != nil {
+		return err
+	}
+	level.Debug(s.Logger).Log("msg", "rolling out next color", "namespace", next.GetNamespace(), "name", next.GetName(), "color", nextColor)
+	if err := createOrUpdate(ctx, rc, next); err != nil {
+		return fmt.Errorf("roll out %s: %w", next.GetName(), err)
+	}
+
+	if err := s.Checks.RunChecks(ctx, s.Step.Success, next); err != nil {
+		var errs error = &checksFailedError{err: fmt.Errorf("%s failed: %w", next.GetName(), err)}
+		cleanupCtx, cancel := cleanupContext()
+		defer cancel()
+		if err := s.setCondition(cleanupCtx, condition, feedback.StatusConditionFailed); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		if err := deleteIfExists(cleanupCtx, rc, next.GetName()); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("remove %s: %w", next.GetName(), err))
+		}
+		return errs
+	}
+
+	if err := s.snapshot(ctx, src, service); err != nil {
+		return err
+	}
+	level.Debug(s.Logger).Log("msg", "switching service", "namespace", service.GetNamespace(), "name", service.GetName(), "color", nextColor)
+	if err := switchService(ctx, src, service.GetName(), nextColor); err != nil {
+		return err
+	}
+
+	if previousColor != "" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(a.DeleteDelay):
+		}
+
+		previous, err := colored(u, previousColor)
+		if err != nil {
+			return err
+		}
+		// Should the rollout be rolled back, the Service is switched back
+		// to the previous color, which must then exist again.
+		if err := s.snapshot(ctx, rc, previous); err != nil {
+			return err
+		}
+		level.Debug(s.Logger).Log("msg", "removing previous color", "namespace", u.GetNamespace(), "name", previous.GetName())
+		if err := deleteIfExists(ctx, rc, previous.GetName()); err != nil {
+			return fmt.Errorf("remove %s: %w", previous.GetName(), err)
+		}
+	}
+
+	return s.setCondition(ctx, condition, feedback.StatusConditionFinished)
+}
+
+// colored returns the Deployment of the given color.
+func colored(u *unstructured.Unstructured, color string) (*unstructured.Unstructured, error) {
+	c := u.DeepCopy()
+	c.SetName(u.GetName() + "-" + color)
+	if err := setPodLabel(c, ColorLabel, color); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
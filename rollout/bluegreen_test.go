@@ -0,0 +1,196 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// blueGreenService returns the app Service selecting the color, none if
+// empty.
+func blueGreenService(t *testing.T, color string) *unstructured.Unstructured {
+	t.Helper()
+
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("v1")
+	u.SetKind("Service")
+	u.SetNamespace("default")
+	u.SetName("app")
+	selector := map[string]interface{}{"app": "app"}
+	if color != "" {
+		selector[ColorLabel] = color
+	}
+	if err := unstructured.SetNestedField(u.Object, selector, "spec", "selector"); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// blueGreenDeployment returns the app Deployment switched through the app
+// Service.
+func blueGreenDeployment(t *testing.T, image string) *unstructured.Unstructured {
+	t.Helper()
+
+	u := appDeployment(t, image, 3)
+	u.SetAnnotations(map[string]string{BlueGreenServiceAnnotation: "app"})
+	return u
+}
+
+func selectedColor(t *testing.T, s *StepContext) string {
+	t.Helper()
+
+	rc, err := s.Client.ClientForUnstructured(blueGreenService(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := rc.Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	color, _, _ := unstructured.NestedString(service.Object, "spec", "selector", ColorLabel)
+	return color
+}
+
+func TestBlueGreen(t *testing.T) {
+	blue, err := colored(blueGreenDeployment(t, "app:v1"), colorBlue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	green, err := colored(blueGreenDeployment(t, "app:v1"), colorGreen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		objects  []runtime.Object
+		next     string
+		expected []string
+	}{{
+		name:     "no live color",
+		objects:  []runtime.Object{blueGreenService(t, "")},
+		next:     colorBlue,
+		expected: []string{"create app-blue", "patch app"},
+	}, {
+		name:     "blue live",
+		objects:  []runtime.Object{blueGreenService(t, colorBlue), blue},
+		next:     colorGreen,
+		expected: []string{"create app-green", "patch app", "delete app-blue"},
+	}, {
+		name:     "green live",
+		objects:  []runtime.Object{blueGreenService(t, colorGreen), green},
+		next:     colorBlue,
+		expected: []string{"create app-blue", "patch app", "delete app-green"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			step := &types.Step{Object: "app", Action: "BlueGreen", Success: replicasSuccess(3)}
+			dc, s, rc := stepFixture(t, step, nil, tc.objects...)
+
+			if err := (&BlueGreenObjectAction{}).ExecuteStep(ctx, s, rc, blueGreenDeployment(t, "app:v2")); err != nil {
+				t.Fatal(err)
+			}
+
+			if c := changes(dc); !reflect.DeepEqual(c, tc.expected) {
+				t.Fatalf("expected changes %v, got %v", tc.expected, c)
+			}
+			if color := selectedColor(t, s); color != tc.next {
+				t.Fatalf("expected the Service to be switched to %s, got %q", tc.next, color)
+			}
+			next, err := rc.Get(ctx, "app-"+tc.next, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if image(t, next) != "app:v2" {
+				t.Fatalf("expected the next color to be rolled out, got image %s", image(t, next))
+			}
+		})
+	}
+}
+
+func TestBlueGreenDeleteDelay(t *testing.T) {
+	blue, err := colored(blueGreenDeployment(t, "app:v1"), colorBlue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := &types.Step{Object: "app", Action: "BlueGreen", Success: replicasSuccess(3)}
+	dc, s, rc := stepFixture(t, step, nil, blueGreenService(t, colorBlue), blue)
+
+	delay := 50 * time.Millisecond
+	begin := time.Now()
+	if err := (&BlueGreenObjectAction{DeleteDelay: delay}).ExecuteStep(context.Background(), s, rc, blueGreenDeployment(t, "app:v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous color is only deleted once the delay passed after the
+	// switch.
+	expected := []string{"create app-green", "patch app", "delete app-blue"}
+	if c := changes(dc); !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected changes %v, got %v", expected, c)
+	}
+	if d := time.Since(begin); d < delay {
+		t.Fatalf("expected the previous color to be deleted after %s, took %s", delay, d)
+	}
+}
+
+func TestBlueGreenDeleteDelayCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	blue, err := colored(blueGreenDeployment(t, "app:v1"), colorBlue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := &types.Step{Object: "app", Action: "BlueGreen", Success: replicasSuccess(3)}
+	dc, s, rc := stepFixture(t, step, nil, blueGreenService(t, colorBlue), blue)
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err = (&BlueGreenObjectAction{DeleteDelay: time.Minute}).ExecuteStep(ctx, s, rc, blueGreenDeployment(t, "app:v2"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the step to be cancelled, got %v", err)
+	}
+
+	// The previous color is kept, so that a rollback can switch back.
+	expected := []string{"create app-green", "patch app"}
+	if c := changes(dc); !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected changes %v, got %v", expected, c)
+	}
+}
+
+func TestBlueGreenFailedChecks(t *testing.T) {
+	ctx := context.Background()
+	blue, err := colored(blueGreenDeployment(t, "app:v1"), colorBlue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The next color has three replicas, so it never gets to five.
+	step := &types.Step{Object: "app", Action: "BlueGreen", Success: replicasSuccess(5)}
+	dc, s, rc := stepFixture(t, step, nil, blueGreenService(t, colorBlue), blue)
+
+	err = (&BlueGreenObjectAction{}).ExecuteStep(ctx, s, rc, blueGreenDeployment(t, "app:v2"))
+	if err == nil {
+		t.Fatal("expected the next color to fail")
+	}
+	if class, ok := classifyError(err); !ok || class != types.ErrorClassCheckFailed {
+		t.Fatalf("expected the error to be classified as %s, got %q", types.ErrorClassCheckFailed, class)
+	}
+
+	// The next color is removed, the Service and the previous color are
+	// untouched.
+	expected := []string{"create app-green", "delete app-green"}
+	if c := changes(dc); !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected changes %v, got %v", expected, c)
+	}
+	if color := selectedColor(t, s); color != colorBlue {
+		t.Fatalf("expected the Service to still select %s, got %q", colorBlue, color)
+	}
+	if _, err := rc.Get(ctx, "app-blue", metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the previous color to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/hashicorp/go-multierror"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/feedback"
+)
+
+const (
+	// TrackLabel distinguishes the pods of a canary from the pods of the
+	// deployment it is a canary of.
+	TrackLabel = "locutus.io/track"
+
+	DefaultCanaryReplicas = 1
+
+	canaryTrack  = "canary"
+	canarySuffix = "-canary"
+)
+
+var (
+	ErrNotADeployment = errors.New("object is not a Deployment")
+)
+
+// CanaryObjectAction first rolls out a canary copy of a Deployment, with a
+// reduced number of replicas, and runs the step's success checks against it.
+// Only if the canary succeeds, the Deployment itself is updated. The canary is
+// removed either way.
+type CanaryObjectAction struct {
+	// Replicas is the number of replicas of the canary.
+	Replicas int64
+}
+
+func (a *CanaryObjectAction) Name() string {
+	return "Canary"
+}
+
+// Execute updates the Deployment directly, as without a step there are no
+// success checks to run against the canary.
+func (a *CanaryObjectAction) Execute(ctx context.Context, rc *client.ResourceClient, u *unstructured.Unstructured) error {
+	return createOrUpdate(ctx, rc, u)
+}
+
+func (a *CanaryObjectAction) ExecuteStep(ctx context.Context, s *StepContext, rc *client.ResourceClient, u *unstructured.Unstructured) error {
+	if u.GetKind() != "Deployment" {
+		return ErrNotADeployment
+	}
+
+	canary, err := a.canaryFor(u)
+	if err != nil {
+		return fmt.Errorf("create canary: %w", err)
+	}
+	condition := "canary/" + canary.GetName()
+
+	if err := s.setCondition(ctx, condition, feedback.StatusConditionInProgress); err != nil {
+		return err
+	}
+
+	level.Debug(s.Logger).Log("msg", "rolling out canary", "namespace", canary.GetNamespace(), "name", canary.GetName())
+	if err := createOrUpdate(ctx, rc, canary); err != nil {
+		return fmt.Errorf("roll out canary %s: %w", canary.GetName(), err)
+	}
+
+	if err := s.Checks.RunChecks(ctx, s.Step.Success, canary); err != nil {
+		var errs error = &checksFailedError{err: fmt.Errorf("canary %s failed: %w", canary.GetName(), err)}
+		cleanupCtx, cancel := cleanupContext()
+		defer cancel()
+		if err := s.setCondition(cleanupCtx, condition, feedback.StatusConditionFailed); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		if err := deleteIfExists(cleanupCtx, rc, canary.GetName()); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("remove canary: %w", err))
+		}
+		return errs
+	}
+
+	level.Debug(s.Logger).Log("msg", "canary succeeded, promoting", "namespace", u.GetNamespace(), "name", u.GetName())
+	if err := createOrUpdate(ctx, rc, u); err != nil {
+		cleanupCtx, cancel := cleanupContext()
+		defer cancel()
+		var errs error = fmt.Errorf("promote canary %s: %w", canary.GetName(), err)
+		if err := deleteIfExists(cleanupCtx, rc, canary.GetName()); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("remove canary: %w", err))
+		}
+		return errs
+	}
+
+	if err := deleteIfExists(ctx, rc, canary.GetName()); err != nil {
+		return fmt.Errorf("remove canary: %w", err)
+	}
+
+	return s.setCondition(ctx, condition, feedback.StatusConditionFinished)
+}
+
+// canaryFor returns a copy of the Deployment with the canary's name and
+// number of replicas, whose pods are distinguished by the track label.
+func (a *CanaryObjectAction) canaryFor(u *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	canary := u.DeepCopy()
+	canary.SetName(u.GetName() + canarySuffix)
+	canary.SetResourceVersion("")
+
+	replicas := a.Replicas
+	if replicas <= 0 {
+		replicas = DefaultCanaryReplicas
+	}
+	if err := unstructured.SetNestedField(canary.Object, replicas, "spec", "replicas"); err != nil {
+		return nil, err
+	}
+
+	if err := setPodLabel(canary, TrackLabel, canaryTrack); err != nil {
+		return nil, err
+	}
+
+	return canary, nil
+}
+
+// setPodLabel sets the label on the Deployment, its selector and its pod
+// template.
+func setPodLabel(u *unstructured.Unstructured, key, value string) error {
+	labels := u.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[key] = value
+	u.SetLabels(labels)
+
+	for _, path := range [][]string{
+		{"spec", "selector", "matchLabels"},
+		{"spec", "template", "metadata", "labels"},
+	} {
+		if err := unstructured.SetNestedField(u.Object, value, append(path, key)...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
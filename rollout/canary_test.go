@@ -0,0 +1,257 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/rollout/checks"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// contextResourceInterface fails requests made with a done context, like a
+// real API client does.
+type contextResourceInterface struct {
+	dynamic.ResourceInterface
+}
+
+func (ri contextResourceInterface) Create(ctx context.Context, obj *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ri.ResourceInterface.Create(ctx, obj, options, subresources...)
+}
+
+func (ri contextResourceInterface) Update(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ri.ResourceInterface.Update(ctx, obj, options, subresources...)
+}
+
+func (ri contextResourceInterface) Delete(ctx context.Context, name string, options metav1.DeleteOptions, subresources ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ri.ResourceInterface.Delete(ctx, name, options, subresources...)
+}
+
+func (ri contextResourceInterface) Get(ctx context.Context, name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ri.ResourceInterface.Get(ctx, name, options, subresources...)
+}
+
+func (ri contextResourceInterface) Patch(ctx context.Context, name string, pt apitypes.PatchType, data []byte, options metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ri.ResourceInterface.Patch(ctx, name, pt, data, options, subresources...)
+}
+
+// cancelCheck is a failure check that cancels the execution, as if it was
+// superseded while the success checks ran.
+type cancelCheck struct {
+	cancel context.CancelFunc
+}
+
+func (c *cancelCheck) Name() string {
+	return "Cancel"
+}
+
+func (c *cancelCheck) Execute(ctx context.Context, client *client.Client, u *unstructured.Unstructured) error {
+	c.cancel()
+	return ctx.Err()
+}
+
+func (c *cancelCheck) IsFailedError(err error) bool {
+	return false
+}
+
+// replicasSuccess succeeds once the object has the number of replicas.
+func replicasSuccess(replicas int64, failure ...*types.FailureDefinition) []*types.SuccessDefinition {
+	return []*types.SuccessDefinition{{
+		FieldComparisons: &types.FieldComparisons{
+			ExpectedValues: []*types.ExpectedFieldComparisonValue{{
+				Name:  "replicas",
+				Path:  "{.spec.replicas}",
+				Value: &types.FieldComparisonValue{StaticInt64: replicas},
+			}},
+			Timeout:         types.Duration{Duration: 20 * time.Millisecond},
+			ProgressTimeout: types.Duration{Duration: 5 * time.Millisecond},
+			PollInterval:    types.Duration{Duration: time.Millisecond},
+		},
+		Failure: failure,
+	}}
+}
+
+// stepFixture returns a client with the objects, whose requests are recorded
+// by the returned fake, the step context running the given checks, and the
+// resource client of Deployments.
+func stepFixture(t *testing.T, step *types.Step, extraChecks []checks.Check, objects ...runtime.Object) (*dynamicfake.FakeDynamicClient, *StepContext, *client.ResourceClient) {
+	t.Helper()
+
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+	cl := discoveryClient()
+	cl.SetDynamicClient(dc)
+	c, err := checks.NewChecks(log.NewNopLogger(), cl, nil, extraChecks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := cl.ClientForUnstructured(deployment("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.ResourceInterface = contextResourceInterface{rc.ResourceInterface}
+
+	return dc, &StepContext{
+		Logger: log.NewNopLogger(),
+		Group:  "main",
+		Step:   step,
+		Client: cl,
+		Checks: c,
+	}, rc
+}
+
+// appDeployment returns the app Deployment with the image and replicas.
+func appDeployment(t *testing.T, image string, replicas int64) *unstructured.Unstructured {
+	t.Helper()
+
+	u := deployment("app")
+	if err := unstructured.SetNestedField(u.Object, replicas, "spec", "replicas"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unstructured.SetNestedField(u.Object, map[string]interface{}{"app": "app"}, "spec", "selector", "matchLabels"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unstructured.SetNestedField(u.Object, map[string]interface{}{"app": "app"}, "spec", "template", "metadata", "labels"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unstructured.SetNestedSlice(u.Object, []interface{}{map[string]interface{}{"name": "app", "image": image}}, "spec", "template", "spec", "containers"); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func image(t *testing.T, u *unstructured.Unstructured) string {
+	t.Helper()
+
+	containers, _, err := unstructured.NestedSlice(u.Object, "spec", "template", "spec", "containers")
+	if err != nil || len(containers) != 1 {
+		t.Fatalf("unexpected containers %v: %v", containers, err)
+	}
+	return containers[0].(map[string]interface{})["image"].(string)
+}
+
+// changes returns the verb and name of every create, update, patch and
+// delete request in order.
+func changes(dc *dynamicfake.FakeDynamicClient) []string {
+	changes := []string{}
+	for _, a := range dc.Actions() {
+		switch a.GetVerb() {
+		case "create", "update":
+			changes = append(changes, a.GetVerb()+" "+a.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).GetName())
+		case "patch", "delete":
+			changes = append(changes, a.GetVerb()+" "+a.(interface{ GetName() string }).GetName())
+		}
+	}
+	return changes
+}
+
+func TestCanaryPromote(t *testing.T) {
+	ctx := context.Background()
+	step := &types.Step{Object: "app", Action: "Canary", Success: replicasSuccess(1)}
+	dc, s, rc := stepFixture(t, step, nil, appDeployment(t, "app:v1", 3))
+
+	if err := (&CanaryObjectAction{Replicas: 1}).ExecuteStep(ctx, s, rc, appDeployment(t, "app:v2", 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"create app-canary", "update app", "delete app-canary"}
+	if c := changes(dc); !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected changes %v, got %v", expected, c)
+	}
+	for _, a := range dc.Actions() {
+		if create, ok := a.(k8stesting.CreateAction); ok && a.GetVerb() == "create" {
+			canary := create.GetObject().(*unstructured.Unstructured)
+			track, _, _ := unstructured.NestedString(canary.Object, "spec", "template", "metadata", "labels", TrackLabel)
+			if canary.GetLabels()[TrackLabel] != canaryTrack || track != canaryTrack {
+				t.Fatalf("expected the canary and its pods to be labelled with %s=%s, got %v", TrackLabel, canaryTrack, canary.Object)
+			}
+		}
+	}
+
+	app, err := rc.Get(ctx, "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image(t, app) != "app:v2" {
+		t.Fatalf("expected the Deployment to be promoted, got image %s", image(t, app))
+	}
+}
+
+func TestCanaryFailedChecks(t *testing.T) {
+	ctx := context.Background()
+	// The canary has one replica, so it never gets to five.
+	step := &types.Step{Object: "app", Action: "Canary", Success: replicasSuccess(5)}
+	dc, s, rc := stepFixture(t, step, nil, appDeployment(t, "app:v1", 3))
+
+	err := (&CanaryObjectAction{Replicas: 1}).ExecuteStep(ctx, s, rc, appDeployment(t, "app:v2", 3))
+	if err == nil {
+		t.Fatal("expected the canary to fail")
+	}
+	if class, ok := classifyError(err); !ok || class != types.ErrorClassCheckFailed {
+		t.Fatalf("expected the error to be classified as %s, got %q", types.ErrorClassCheckFailed, class)
+	}
+
+	expected := []string{"create app-canary", "delete app-canary"}
+	if c := changes(dc); !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected changes %v, got %v", expected, c)
+	}
+	app, err := rc.Get(ctx, "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image(t, app) != "app:v1" {
+		t.Fatalf("expected the Deployment to be untouched, got image %s", image(t, app))
+	}
+}
+
+func TestCanaryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	step := &types.Step{
+		Object:  "app",
+		Action:  "Canary",
+		Success: replicasSuccess(5, &types.FailureDefinition{CheckName: "Cancel"}),
+	}
+	dc, s, rc := stepFixture(t, step, []checks.Check{&cancelCheck{cancel: cancel}}, appDeployment(t, "app:v1", 3))
+
+	err := (&CanaryObjectAction{Replicas: 1}).ExecuteStep(ctx, s, rc, appDeployment(t, "app:v2", 3))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the canary to be cancelled, got %v", err)
+	}
+
+	// The canary is removed even though the execution was cancelled.
+	expected := []string{"create app-canary", "delete app-canary"}
+	if c := changes(dc); !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected changes %v, got %v", expected, c)
+	}
+	if _, err := rc.Get(context.Background(), "app-canary", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the canary to be removed, got %v", err)
+	}
+}
@@ -78,3 +78,11 @@ func (c *Checks) runCheck(
 	}
 	return sc.Execute(ctx, u)
 }
+
+// WithClient returns a copy of the checks that run against the client, for
+// example to check objects in another cluster.
+func (c *Checks) WithClient(client *client.Client) *Checks {
+	cc := *c
+	cc.client = client
+	return &cc
+}
@@ -30,7 +30,15 @@ func (c *JobOOMKilledCheck) Execute(ctx context.Context, client *client.Client,
 		return ErrNotAJob
 	}
 
-	list, err := client.KubeClient().CoreV1().Pods(unstructured.GetNamespace()).List(ctx, metav1.ListOptions{
+	namespace := unstructured.GetNamespace()
+	if namespace == "" {
+		var err error
+		namespace, err = client.ObjectNamespace(unstructured)
+		if err != nil {
+			return err
+		}
+	}
+	list, err := client.KubeClient().CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
 		LabelSelector: fmt.Sprintf("job-name=%s", unstructured.GetName()),
 	})
 	if err != nil {
@@ -0,0 +1,90 @@
+package checks
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+	"k8s.io/client-go/util/jsonpath"
+
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// Validate returns all problems of the success definitions that would only
+// surface once they are run, such as invalid JSONPath expressions, unknown
+// failure checks or database connections, and timeouts that aren't positive.
+func (c *Checks) Validate(successDefs []*types.SuccessDefinition) error {
+	var errs error
+	for i, d := range successDefs {
+		for _, err := range c.validate(d) {
+			errs = multierror.Append(errs, fmt.Errorf("success definition #%d: %w", i, err))
+		}
+	}
+
+	return errs
+}
+
+func (c *Checks) validate(def *types.SuccessDefinition) []error {
+	fc := def.FieldComparisons
+	if fc == nil {
+		return []error{fmt.Errorf("fieldComparisons is required")}
+	}
+
+	errs := []error{}
+	parse := func(path string) {
+		if err := jsonpath.New("rollout jsonpath").Parse(path); err != nil {
+			errs = append(errs, fmt.Errorf("invalid path %q: %w", path, err))
+		}
+	}
+	for _, ev := range fc.ExpectedValues {
+		parse(ev.Path)
+		if ev.Value != nil && ev.Value.Path != "" {
+			parse(ev.Value.Path)
+		}
+	}
+
+	for _, d := range []struct {
+		name  string
+		value types.Duration
+	}{
+		{"timeout", fc.Timeout},
+		{"progressTimeout", fc.ProgressTimeout},
+		{"pollInterval", fc.PollInterval},
+	} {
+		if d.value.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", d.name, d.value.Duration))
+		}
+	}
+
+	if err := c.validateReport(fc.ReportTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("reportTimeout: %w", err))
+	}
+	for _, fd := range append(append([]*types.FailureDefinition{}, def.Failure...), fc.Failure...) {
+		if _, ok := c.knownChecks[fd.CheckName]; !ok {
+			errs = append(errs, fmt.Errorf("unknown failure check %q", fd.CheckName))
+		}
+		if err := c.validateReport(fd.Report); err != nil {
+			errs = append(errs, fmt.Errorf("failure check %q report: %w", fd.CheckName, err))
+		}
+	}
+
+	return errs
+}
+
+func (c *Checks) validateReport(report *types.ReportConfig) error {
+	if report == nil || report.Database == nil {
+		return nil
+	}
+	if !c.hasDatabaseConnection(report.Database.DatabaseName) {
+		return fmt.Errorf("database connection %s not found", report.Database.DatabaseName)
+	}
+
+	return nil
+}
+
+func (c *Checks) hasDatabaseConnection(name string) bool {
+	if c.databaseConnections == nil {
+		return false
+	}
+	_, ok := c.databaseConnections.Connections[name]
+	return ok
+}
@@ -0,0 +1,74 @@
+package rollout
+
+import (
+	"errors"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/rollout/checks"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+var ErrUnknownCluster = errors.New("unknown cluster")
+
+// cluster is a cluster objects are rolled out to. The cluster locutus runs
+// against has an empty name.
+type cluster struct {
+	name   string
+	client *client.Client
+	checks *checks.Checks
+}
+
+// stepCluster returns the name of the cluster the step rolls out to.
+func stepCluster(group *types.RolloutGroup, step *types.Step) string {
+	if step.Cluster != "" {
+		return step.Cluster
+	}
+	return group.Cluster
+}
+
+func (r *Runner) cluster(name string) (*cluster, error) {
+	if name == "" {
+		return &cluster{client: r.client, checks: r.checks}, nil
+	}
+
+	c, ok := r.clusters[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCluster, name)
+	}
+
+	cl := &cluster{name: name, client: c}
+	if r.checks != nil {
+		cl.checks = r.checks.WithClient(c)
+	}
+
+	return cl, nil
+}
+
+// foreignObject returns the object to roll out to a cluster other than the
+// one locutus runs against. Owner references to the resource that triggered
+// the execution can't be resolved there, and would get the object garbage
+// collected, so they are removed.
+func foreignObject(config *Config, u *unstructured.Unstructured) *unstructured.Unstructured {
+	if config == nil || config.Object == nil {
+		return u
+	}
+
+	refs := u.GetOwnerReferences()
+	kept := make([]metav1.OwnerReference, 0, len(refs))
+	for _, ref := range refs {
+		if ref.UID != config.Object.GetUID() {
+			kept = append(kept, ref)
+		}
+	}
+	if len(kept) == len(refs) {
+		return u
+	}
+
+	u = u.DeepCopy()
+	u.SetOwnerReferences(kept)
+	return u
+}
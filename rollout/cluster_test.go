@@ -0,0 +1,71 @@
+package rollout
+
+import (
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+func TestClusters(t *testing.T) {
+	staging := discoveryClient()
+	r := &Runner{
+		client:   discoveryClient(),
+		clusters: map[string]*client.Client{"staging": staging},
+	}
+
+	cl, err := r.cluster("staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.client != staging {
+		t.Fatal("expected the client of the staging cluster")
+	}
+	if _, err := r.cluster("production"); !errors.Is(err, ErrUnknownCluster) {
+		t.Fatalf("expected unknown cluster error, got %v", err)
+	}
+
+	res := &render.Result{
+		Objects: map[string]*unstructured.Unstructured{"cm": configMap("cm", "value")},
+		Rollout: &types.Rollout{Spec: &types.RolloutSpec{Groups: []*types.RolloutGroup{
+			{Name: "staging", Cluster: "staging", Steps: []*types.Step{{Object: "cm", Action: "CreateOrUpdate"}}},
+			{Name: "production", Steps: []*types.Step{{Object: "cm", Action: "CreateOrUpdate", Cluster: "production"}}},
+			{Name: "local", Steps: []*types.Step{{Object: "cm", Action: "CreateOrUpdate"}}},
+		}}},
+	}
+	refs, err := r.appliedRefs(&execution{res: res})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"staging:v1/ConfigMap/default/cm",
+		"production:v1/ConfigMap/default/cm",
+		"v1/ConfigMap/default/cm",
+	} {
+		if _, ok := refs[expected]; !ok {
+			t.Errorf("expected %s to be applied, got %v", expected, refs)
+		}
+	}
+}
+
+func TestForeignObject(t *testing.T) {
+	owner := configMap("owner", "value")
+	owner.SetUID("1234")
+
+	u := configMap("cm", "value")
+	u.SetOwnerReferences([]metav1.OwnerReference{{Name: "owner", UID: "1234"}, {Name: "other", UID: "5678"}})
+
+	foreign := foreignObject(&Config{Object: owner}, u)
+	refs := foreign.GetOwnerReferences()
+	if len(refs) != 1 || refs[0].UID != "5678" {
+		t.Fatalf("unexpected owner references %v", refs)
+	}
+	if len(u.GetOwnerReferences()) != 2 {
+		t.Fatal("expected the rendered object to be unchanged")
+	}
+}
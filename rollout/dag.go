@@ -0,0 +1,317 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// dag is a directed acyclic graph of nodes identified by their index. Each
+// node may depend on any number of other nodes.
+type dag struct {
+	names []string
+	deps  [][]int
+}
+
+// newGraph builds the dependency graph of a list of named nodes. Nodes depend
+// on the nodes they declare. If chain is true, nodes that don't declare any
+// dependencies implicitly depend on the node before them, so that declaring
+// dependencies on some nodes doesn't run the others concurrently. Names must
+// be unique, unnamed nodes can't be depended on.
+func newGraph(kind string, names []string, dependsOn [][]string, chain bool) (*dag, error) {
+	d := &dag{
+		names: make([]string, len(names)),
+		deps:  make([][]int, len(names)),
+	}
+	for i, name := range names {
+		d.names[i] = name
+		if name == "" {
+			d.names[i] = fmt.Sprintf("#%d", i)
+		}
+	}
+
+	var errs error
+	index := map[string]int{}
+	for i, name := range names {
+		if name == "" {
+			continue
+		}
+		if _, ok := index[name]; ok {
+			errs = multierror.Append(errs, fmt.Errorf("duplicate %s name %q", kind, name))
+			continue
+		}
+		index[name] = i
+	}
+
+	for i := range names {
+		var deps []string
+		if i < len(dependsOn) {
+			deps = dependsOn[i]
+		}
+		if len(deps) == 0 && chain && i > 0 {
+			d.deps[i] = []int{i - 1}
+			continue
+		}
+		for _, dep := range deps {
+			j, ok := index[dep]
+			if !ok {
+				errs = multierror.Append(errs, fmt.Errorf("%s %q depends on unknown %s %q", kind, d.names[i], kind, dep))
+				continue
+			}
+			d.deps[i] = append(d.deps[i], j)
+		}
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	if cycle := d.findCycle(); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle between %ss: %s", kind, strings.Join(cycle, " -> "))
+	}
+
+	return d, nil
+}
+
+// findCycle returns the names of the nodes that form a cycle, or nil if the
+// graph is acyclic.
+func (d *dag) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(d.names))
+	stack := []int{}
+
+	var visit func(i int) []string
+	visit = func(i int) []string {
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, dep := range d.deps[i] {
+			switch state[dep] {
+			case visiting:
+				p := len(stack) - 1
+				for stack[p] != dep {
+					p--
+				}
+				cycle := []string{}
+				for _, k := range stack[p:] {
+					cycle = append(cycle, d.names[k])
+				}
+				return append(cycle, d.names[dep])
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range d.names {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
+
+// order returns the nodes in an order in which every node comes after its
+// dependencies. Of the nodes whose dependencies come before them, the one
+// declared first comes first.
+func (d *dag) order() []int {
+	placed := make([]bool, len(d.names))
+	order := make([]int, 0, len(d.names))
+	for len(order) < len(d.names) {
+		for i, deps := range d.deps {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for _, dep := range deps {
+				if !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				placed[i] = true
+				order = append(order, i)
+				break
+			}
+		}
+	}
+	return order
+}
+
+// run executes fn for every node once all of its dependencies have
+// succeeded. Nodes whose dependencies are satisfied run concurrently, nodes
+// whose dependencies failed are never run. If failFast is set, the context
+// passed to running nodes is cancelled on the first failure and no further
+// nodes are started.
+func (d *dag) run(ctx context.Context, failFast bool, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dependents := make([][]int, len(d.names))
+	pending := make([]int, len(d.names))
+	for i, deps := range d.deps {
+		pending[i] = len(deps)
+		for _, dep := range deps {
+			dependents[dep] = append(dependents[dep], i)
+		}
+	}
+
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result)
+	running := 0
+	start := func(i int) {
+		running++
+		go func() {
+			results <- result{i: i, err: fn(ctx, i)}
+		}()
+	}
+
+	for i := range pending {
+		if pending[i] == 0 {
+			start(i)
+		}
+	}
+
+	var errs error
+	for running > 0 {
+		res := <-results
+		running--
+
+		if res.err != nil {
+			errs = multierror.Append(errs, res.err)
+			if failFast {
+				cancel()
+			}
+			continue
+		}
+
+		if failFast && errs != nil {
+			continue
+		}
+
+		for _, dependent := range dependents[res.i] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				start(dependent)
+			}
+		}
+	}
+
+	return errs
+}
+
+// plan is the graph of groups and steps of a rollout, built before anything
+// is applied so that invalid dependencies are rejected up front.
+type plan struct {
+	groups *dag
+	steps  []*dag
+	// groupWhen and stepWhen hold the compiled `when` expressions of the
+	// groups and steps that have one.
+	groupWhen map[*types.RolloutGroup]cel.Program
+	stepWhen  map[*types.Step]cel.Program
+}
+
+func newPlan(spec *types.RolloutSpec) (*plan, error) {
+	var errs error
+
+	names := make([]string, 0, len(spec.Groups))
+	dependsOn := make([][]string, 0, len(spec.Groups))
+	for _, g := range spec.Groups {
+		names = append(names, g.Name)
+		dependsOn = append(dependsOn, g.DependsOn)
+	}
+
+	groups, err := newGraph("group", names, dependsOn, !spec.Parallel)
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
+	p := &plan{
+		groupWhen: map[*types.RolloutGroup]cel.Program{},
+		stepWhen:  map[*types.Step]cel.Program{},
+	}
+	var env *cel.Env
+	compile := func(expr string) (cel.Program, error) {
+		if env == nil {
+			var err error
+			if env, err = whenEnv(); err != nil {
+				return nil, err
+			}
+		}
+		return compileWhen(env, expr)
+	}
+
+	steps := make([]*dag, 0, len(spec.Groups))
+	for _, g := range spec.Groups {
+		if g.When != "" {
+			prg, err := compile(g.When)
+			if err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("group %q: %w", g.Name, err))
+			}
+			p.groupWhen[g] = prg
+		}
+
+		switch g.FailurePolicy {
+		case "", types.FailurePolicyFailFast, types.FailurePolicyWaitForAll, types.FailurePolicyContinue:
+		default:
+			errs = multierror.Append(errs, fmt.Errorf("group %q: unknown failure policy %q", g.Name, g.FailurePolicy))
+		}
+		for _, h := range append(append([]*types.Hook{}, g.PreHooks...), g.PostHooks...) {
+			switch h.DeletePolicy {
+			case "", types.HookDeletePolicyBeforeCreation, types.HookDeletePolicyOnSuccess, types.HookDeletePolicyNever:
+			default:
+				errs = multierror.Append(errs, fmt.Errorf("group %q, hook %q: unknown delete policy %q", g.Name, h.Object, h.DeletePolicy))
+			}
+		}
+
+		names := make([]string, 0, len(g.Steps))
+		dependsOn := make([][]string, 0, len(g.Steps))
+		for _, s := range g.Steps {
+			names = append(names, s.Name)
+			dependsOn = append(dependsOn, s.DependsOn)
+
+			if s.When != "" {
+				prg, err := compile(s.When)
+				if err != nil {
+					errs = multierror.Append(errs, fmt.Errorf("group %q, step %q: %w", g.Name, s.Name, err))
+				}
+				p.stepWhen[s] = prg
+			}
+		}
+
+		s, err := newGraph("step", names, dependsOn, !g.Parallel)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("group %q: %w", g.Name, err))
+		}
+		steps = append(steps, s)
+	}
+
+	if errs != nil {
+		return nil, errs
+	}
+
+	p.groups = groups
+	p.steps = steps
+
+	return p, nil
+}
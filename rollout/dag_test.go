@@ -0,0 +1,160 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGraphRejectsInvalidDependencies(t *testing.T) {
+	cases := []struct {
+		name      string
+		names     []string
+		dependsOn [][]string
+		err       string
+	}{
+		{
+			name:      "unknown",
+			names:     []string{"a", "b"},
+			dependsOn: [][]string{nil, {"c"}},
+			err:       `step "b" depends on unknown step "c"`,
+		},
+		{
+			name:      "cycle",
+			names:     []string{"a", "b", "c"},
+			dependsOn: [][]string{{"c"}, {"a"}, {"b"}},
+			err:       "dependency cycle between steps: a -> c -> b -> a",
+		},
+		{
+			name:      "self",
+			names:     []string{"a"},
+			dependsOn: [][]string{{"a"}},
+			err:       "dependency cycle between steps: a -> a",
+		},
+		{
+			name:      "duplicate",
+			names:     []string{"a", "a", "b"},
+			dependsOn: [][]string{nil, nil, {"a"}},
+			err:       `duplicate step name "a"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := newGraph("step", c.names, c.dependsOn, true)
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("expected error to contain %q, got: %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestGraphRunOrder(t *testing.T) {
+	// d depends on b and c, which both depend on a.
+	d, err := newGraph("step", []string{"a", "b", "c", "d"}, [][]string{nil, {"a"}, {"a"}, {"b", "c"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mtx sync.Mutex
+	done := map[int]bool{}
+	err = d.run(context.Background(), false, func(_ context.Context, i int) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, dep := range d.deps[i] {
+			if !done[dep] {
+				t.Errorf("%s started before its dependency %s finished", d.names[i], d.names[dep])
+			}
+		}
+		done[i] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 4 {
+		t.Fatalf("expected all 4 nodes to run, ran %d", len(done))
+	}
+}
+
+func TestGraphRunSkipsDependentsOfFailures(t *testing.T) {
+	d, err := newGraph("step", []string{"a", "b", "c"}, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ran := []int{}
+	err = d.run(context.Background(), false, func(_ context.Context, i int) error {
+		ran = append(ran, i)
+		if i == 1 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if len(ran) != 2 {
+		t.Fatalf("expected only the first two nodes to run, ran %v", ran)
+	}
+}
+
+func TestGraphRunFailFastCancelsSiblings(t *testing.T) {
+	d, err := newGraph("step", []string{"a", "b"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.run(context.Background(), true, func(ctx context.Context, i int) error {
+		if i == 0 {
+			return errors.New("failed")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected sibling to be cancelled, got: %v", err)
+	}
+}
+
+func TestGraphKeepsImplicitOrderOfUndeclaredDependencies(t *testing.T) {
+	names := []string{"a", "b", "c", "d"}
+	dependsOn := [][]string{nil, nil, {"a"}, nil}
+
+	d, err := newGraph("step", names, dependsOn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{nil, {0}, {0}, {2}}
+	if !reflect.DeepEqual(d.deps, expected) {
+		t.Fatalf("expected dependencies %v, got %v", expected, d.deps)
+	}
+
+	d, err = newGraph("step", names, dependsOn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = [][]int{nil, nil, {0}, nil}
+	if !reflect.DeepEqual(d.deps, expected) {
+		t.Fatalf("expected dependencies %v, got %v", expected, d.deps)
+	}
+}
+
+func TestGraphOrder(t *testing.T) {
+	// a depends on c, which depends on b.
+	d, err := newGraph("step", []string{"a", "b", "c", "d"}, [][]string{{"c"}, nil, {"b"}, nil}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{1, 2, 0, 3}
+	if order := d.order(); !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected order %v, got %v", expected, order)
+	}
+}
@@ -0,0 +1,323 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/hashicorp/go-multierror"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// driftedField is a field of a rendered object whose live value differs.
+type driftedField struct {
+	Path     string      `json:"path"`
+	Rendered interface{} `json:"rendered"`
+	Live     interface{} `json:"live,omitempty"`
+}
+
+// driftSeries are the label values of a series of the drift metric.
+type driftSeries struct {
+	cluster, gvk, object string
+}
+
+// detectDrift compares every object the rollout would roll out with its live
+// state, and reports drifted objects through the drift metric and the log.
+// Nothing is changed in the cluster.
+func (r *Runner) detectDrift(ctx context.Context, e *execution) error {
+	series := map[driftSeries]bool{}
+	defer r.replaceDriftSeries(executionKey(e.config, e.res), series)
+
+	var errs error
+	drifted := 0
+	for _, group := range e.res.Rollout.Spec.Groups {
+		if skip, err := e.skipped(e.plan.groupWhen[group]); err != nil || skip {
+			continue
+		}
+		for _, step := range group.Steps {
+			if step.Gate != nil || !ownsObject(step.Action) {
+				continue
+			}
+			if skip, err := e.skipped(e.plan.stepWhen[step]); err != nil || skip {
+				continue
+			}
+			object, found := e.res.Objects[step.Object]
+			if !found {
+				continue
+			}
+			cl, err := r.cluster(stepCluster(group, step))
+			if err != nil {
+				errs = multierror.Append(errs, err)
+				continue
+			}
+
+			err = eachObject(object, func(u *unstructured.Unstructured) error {
+				if cl.name != "" {
+					u = foreignObject(e.config, u)
+				}
+				u, err := r.liveObject(ctx, cl, step, u)
+				if err != nil {
+					return fmt.Errorf("detect drift of %s: %w", objectKey(u), err)
+				}
+				diff, err := r.objectDrift(ctx, cl, u, ignoreDifferences(e.res.Rollout.Spec, step))
+				if err != nil {
+					return fmt.Errorf("detect drift of %s: %w", objectKey(u), err)
+				}
+
+				name := u.GetName()
+				if u.GetNamespace() != "" {
+					name = u.GetNamespace() + "/" + name
+				}
+				gvk := u.GetAPIVersion() + "/" + u.GetKind()
+				series[driftSeries{cluster: cl.name, gvk: gvk, object: name}] = true
+				if diff == nil {
+					r.metrics.drift.WithLabelValues(cl.name, gvk, name).Set(0)
+					return nil
+				}
+
+				drifted++
+				r.metrics.drift.WithLabelValues(cl.name, gvk, name).Set(1)
+				b, err := json.Marshal(diff)
+				if err != nil {
+					return err
+				}
+				level.Warn(r.logger).Log("msg", "object drifted", "cluster", cl.name, "gvk", gvk, "object", name, "diff", string(b))
+				return nil
+			})
+			if err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+
+	level.Info(r.logger).Log("msg", "drift detection finished", "drifted", drifted)
+	return errs
+}
+
+// replaceDriftSeries records the series of the drift metric set for the key,
+// and deletes those set by its previous drift detection that weren't set
+// again, unless another key set them.
+func (r *Runner) replaceDriftSeries(key string, series map[driftSeries]bool) {
+	r.driftMtx.Lock()
+	defer r.driftMtx.Unlock()
+
+	if r.driftSeries == nil {
+		r.driftSeries = map[string]map[driftSeries]bool{}
+	}
+	previous := r.driftSeries[key]
+	r.driftSeries[key] = series
+
+	for s := range previous {
+		if series[s] || r.driftSeriesInUse(s) {
+			continue
+		}
+		r.metrics.drift.DeleteLabelValues(s.cluster, s.gvk, s.object)
+	}
+}
+
+// driftSeriesInUse returns whether any key set the series. driftMtx must be
+// held.
+func (r *Runner) driftSeriesInUse(s driftSeries) bool {
+	for _, series := range r.driftSeries {
+		if series[s] {
+			return true
+		}
+	}
+	return false
+}
+
+// liveObject returns the object the step rolls out for the rendered object.
+// A BlueGreen step never rolls out the rendered object, but the color the
+// Service selects, or the first color if it selects none yet.
+func (r *Runner) liveObject(ctx context.Context, cl *cluster, step *types.Step, u *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	a, ok := r.actions[step.Action].(*BlueGreenObjectAction)
+	if !ok {
+		return u, nil
+	}
+
+	state, err := a.state(ctx, &StepContext{Step: step, Client: cl.client}, u)
+	if err != nil {
+		return u, err
+	}
+	color := state.previousColor
+	if color == "" {
+		color = state.nextColor
+	}
+	live, err := colored(u, color)
+	if err != nil {
+		return u, err
+	}
+	return live, nil
+}
+
+// objectDrift returns the fields of the rendered object that differ from the
+// live object, or nil if there are none. Fields only set on the live object,
+// such as those populated by the API server, are not considered drift. A
+// missing live object is reported as a drift of the whole object, ignored
+// fields are not.
+func (r *Runner) objectDrift(ctx context.Context, cl *cluster, u *unstructured.Unstructured, ignores []*client.IgnoreDifferences) ([]driftedField, error) {
+	rc, err := cl.client.ClientForUnstructured(u)
+	if err != nil {
+		return nil, err
+	}
+	rc = rc.WithIgnoreDifferences(ignores...)
+
+	live, err := rc.Get(ctx, u.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return []driftedField{{Path: ".", Rendered: "object does not exist"}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := u.DeepCopy()
+	unstructured.RemoveNestedField(rendered.Object, "status")
+	if err := rc.CopyIgnoredFields(live, rendered); err != nil {
+		return nil, err
+	}
+	diff := compareFields("", rendered.Object, live.Object, nil)
+	if len(diff) == 0 {
+		return nil, nil
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		return diff[i].Path < diff[j].Path
+	})
+
+	return diff, nil
+}
+
+// compareFields appends every field set in rendered whose value in live
+// differs to diff. Fields rendered as null are left to the API server, and
+// empty maps and lists equal absent live fields, as the API server drops
+// them.
+func compareFields(path string, rendered, live interface{}, diff []driftedField) []driftedField {
+	if rendered == nil || (live == nil && isEmpty(rendered)) {
+		return diff
+	}
+
+	switch r := rendered.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return append(diff, driftedField{Path: path, Rendered: rendered, Live: live})
+		}
+		keys := make([]string, 0, len(r))
+		for k := range r {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diff = compareFields(path+"."+k, r[k], l[k], diff)
+		}
+		return diff
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(r) {
+			return append(diff, driftedField{Path: path, Rendered: rendered, Live: live})
+		}
+		for i := range r {
+			diff = compareFields(fmt.Sprintf("%s[%d]", path, i), r[i], l[i], diff)
+		}
+		return diff
+	default:
+		if !equalValues(path, rendered, live) {
+			return append(diff, driftedField{Path: path, Rendered: rendered, Live: live})
+		}
+		return diff
+	}
+}
+
+// quantityFields are the fields whose nested string values are resource
+// quantities, such as the requests and limits of containers or the capacity
+// of nodes and volumes.
+var quantityFields = map[string]bool{
+	"resources":   true,
+	"capacity":    true,
+	"allocatable": true,
+	"hard":        true,
+}
+
+// isQuantityPath returns whether the field at the path is nested in one of
+// the quantityFields.
+func isQuantityPath(path string) bool {
+	for _, field := range strings.Split(path, ".") {
+		if i := strings.Index(field, "["); i >= 0 {
+			field = field[:i]
+		}
+		if quantityFields[field] {
+			return true
+		}
+	}
+	return false
+}
+
+// equalValues compares scalar values at the path, treating numbers of
+// different types, and equal resource quantities in different notations in
+// quantity fields, as equal.
+func equalValues(path string, rendered, live interface{}) bool {
+	if reflect.DeepEqual(rendered, live) {
+		return true
+	}
+
+	if rf, ok := toFloat(rendered); ok {
+		lf, ok := toFloat(live)
+		return ok && rf == lf
+	}
+
+	if !isQuantityPath(path) {
+		return false
+	}
+	rs, ok := rendered.(string)
+	if !ok {
+		return false
+	}
+	ls, ok := live.(string)
+	if !ok || strings.TrimSpace(rs) == "" {
+		return false
+	}
+	rq, err := resource.ParseQuantity(rs)
+	if err != nil {
+		return false
+	}
+	lq, err := resource.ParseQuantity(ls)
+	if err != nil {
+		return false
+	}
+	return rq.Cmp(lq) == 0
+}
+
+// isEmpty returns whether the value is an empty map or list.
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
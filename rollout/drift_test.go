@@ -0,0 +1,183 @@
+package rollout
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+func TestCompareFields(t *testing.T) {
+	rendered := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app"},
+		"spec": map[string]interface{}{
+			"replicas": float64(3),
+			"template": map[string]interface{}{
+				"containers": []interface{}{map[string]interface{}{
+					"name":      "app",
+					"image":     "app:v2",
+					"resources": map[string]interface{}{"requests": map[string]interface{}{"cpu": "0.5"}},
+				}},
+			},
+		},
+	}
+	live := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app", "uid": "1234", "resourceVersion": "42"},
+		"spec": map[string]interface{}{
+			"replicas":             int64(3),
+			"revisionHistoryLimit": int64(10),
+			"template": map[string]interface{}{
+				"containers": []interface{}{map[string]interface{}{
+					"name":                     "app",
+					"image":                    "app:v1",
+					"imagePullPolicy":          "IfNotPresent",
+					"resources":                map[string]interface{}{"requests": map[string]interface{}{"cpu": "500m"}},
+					"terminationMessagePolicy": "File",
+				}},
+			},
+		},
+	}
+
+	// Rendered by kubectl and helm style tooling, dropped by the API server.
+	rendered["metadata"].(map[string]interface{})["creationTimestamp"] = nil
+	rendered["metadata"].(map[string]interface{})["annotations"] = map[string]interface{}{}
+	rendered["spec"].(map[string]interface{})["strategy"] = map[string]interface{}{}
+	rendered["spec"].(map[string]interface{})["template"].(map[string]interface{})["volumes"] = []interface{}{}
+	live["metadata"].(map[string]interface{})["creationTimestamp"] = "2023-01-01T00:00:00Z"
+
+	diff := compareFields("", rendered, live, nil)
+	expected := []driftedField{{Path: ".spec.template.containers[0].image", Rendered: "app:v2", Live: "app:v1"}}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("expected %v, got %v", expected, diff)
+	}
+}
+
+func TestEqualValuesQuantities(t *testing.T) {
+	if !equalValues(".spec.containers[0].resources.requests.memory", "1Gi", "1024Mi") {
+		t.Fatal("expected equal quantities in resources to be equal")
+	}
+	if !equalValues(".status.capacity.storage", "1Gi", "1024Mi") {
+		t.Fatal("expected equal quantities in capacity to be equal")
+	}
+	if equalValues(".metadata.annotations.version", "1.0", "1") {
+		t.Fatal("expected strings outside of quantity fields to be compared as they are")
+	}
+	if equalValues(".data.size", "1Gi", "1024Mi") {
+		t.Fatal("expected strings outside of quantity fields to be compared as they are")
+	}
+}
+
+func TestReplaceDriftSeries(t *testing.T) {
+	r := NewRunner(nil, log.NewNopLogger(), nil, nil, nil, DryRunNone)
+	a := driftSeries{gvk: "v1/ConfigMap", object: "default/a"}
+	b := driftSeries{gvk: "v1/ConfigMap", object: "default/b"}
+	shared := driftSeries{gvk: "v1/ConfigMap", object: "default/shared"}
+	set := func(series ...driftSeries) map[driftSeries]bool {
+		m := map[driftSeries]bool{}
+		for _, s := range series {
+			r.metrics.drift.WithLabelValues(s.cluster, s.gvk, s.object).Set(0)
+			m[s] = true
+		}
+		return m
+	}
+
+	r.replaceDriftSeries("first", set(a, shared))
+	r.replaceDriftSeries("second", set(b, shared))
+	if n := testutil.CollectAndCount(r.metrics.drift); n != 3 {
+		t.Fatalf("expected 3 series, got %d", n)
+	}
+
+	// The first key no longer renders a nor shared. The series of the
+	// second key are kept.
+	r.replaceDriftSeries("first", set())
+	if n := testutil.CollectAndCount(r.metrics.drift); n != 2 {
+		t.Fatalf("expected the series of the second key to be kept, got %d series", n)
+	}
+
+	r.replaceDriftSeries("second", set())
+	if n := testutil.CollectAndCount(r.metrics.drift); n != 0 {
+		t.Fatalf("expected no series, got %d", n)
+	}
+}
+
+func TestCompareFieldsEmptyValues(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rendered interface{}
+		live     interface{}
+		drifted  bool
+	}{
+		{name: "null against absent", rendered: nil, live: nil},
+		{name: "null against set", rendered: nil, live: "2023-01-01T00:00:00Z"},
+		{name: "empty map against absent", rendered: map[string]interface{}{}, live: nil},
+		{name: "empty list against absent", rendered: []interface{}{}, live: nil},
+		{name: "empty list against items", rendered: []interface{}{}, live: []interface{}{"a"}, drifted: true},
+		{name: "empty string against absent", rendered: "", live: nil, drifted: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			diff := compareFields(".field", tc.rendered, tc.live, nil)
+			if tc.drifted != (len(diff) > 0) {
+				t.Fatalf("expected drift %t, got %v", tc.drifted, diff)
+			}
+		})
+	}
+}
+
+func TestDetectDriftBlueGreen(t *testing.T) {
+	service := &unstructured.Unstructured{}
+	service.SetAPIVersion("v1")
+	service.SetKind("Service")
+	service.SetNamespace("default")
+	service.SetName("app")
+	if err := unstructured.SetNestedField(service.Object, colorGreen, "spec", "selector", ColorLabel); err != nil {
+		t.Fatal(err)
+	}
+
+	app := deployment("app")
+	app.SetAnnotations(map[string]string{BlueGreenServiceAnnotation: "app"})
+	if err := unstructured.SetNestedField(app.Object, int64(2), "spec", "replicas"); err != nil {
+		t.Fatal(err)
+	}
+	green, err := colored(app, colorGreen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(nil, log.NewNopLogger(), discoveryClient(service, green), nil, nil, DryRunNone)
+	r.SetObjectActions(DefaultObjectActions)
+	r.SetDriftDetection(true)
+	res := &render.Result{
+		Objects: map[string]*unstructured.Unstructured{"app": app},
+		Rollout: &types.Rollout{Spec: &types.RolloutSpec{Groups: []*types.RolloutGroup{{
+			Name:  "main",
+			Steps: []*types.Step{{Object: "app", Action: (&BlueGreenObjectAction{}).Name()}},
+		}}}},
+	}
+	if err := r.Execute(context.Background(), &Config{Key: "app", Rendered: res}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The live color is compared, the rendered object is never rolled out.
+	if v := testutil.ToFloat64(r.metrics.drift.WithLabelValues("", "apps/v1/Deployment", "default/app-green")); v != 0 {
+		t.Fatalf("expected the live color not to have drifted, got %v", v)
+	}
+	if n := testutil.CollectAndCount(r.metrics.drift); n != 1 {
+		t.Fatalf("expected only the series of the live color, got %d series", n)
+	}
+
+	if err := unstructured.SetNestedField(app.Object, int64(3), "spec", "replicas"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Execute(context.Background(), &Config{Key: "app", Rendered: res}); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(r.metrics.drift.WithLabelValues("", "apps/v1/Deployment", "default/app-green")); v != 1 {
+		t.Fatalf("expected the live color to have drifted, got %v", v)
+	}
+}
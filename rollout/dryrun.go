@@ -0,0 +1,316 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pmezard/go-difflib/difflib"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+type DryRunStrategy string
+
+const (
+	// DryRunNone performs the rollout.
+	DryRunNone DryRunStrategy = "none"
+	// DryRunClient only renders and prints the render result.
+	DryRunClient DryRunStrategy = "client"
+	// DryRunServer runs all actions as server-side dry runs and prints the
+	// difference between the live objects and the dry run results.
+	DryRunServer DryRunStrategy = "server"
+)
+
+var DryRunStrategies = []DryRunStrategy{
+	DryRunNone,
+	DryRunClient,
+	DryRunServer,
+}
+
+// dryRunResourceInterface performs all mutating requests as server-side dry
+// runs, and records the object resulting from them.
+type dryRunResourceInterface struct {
+	dynamic.ResourceInterface
+
+	result  *unstructured.Unstructured
+	deleted bool
+}
+
+func (d *dryRunResourceInterface) record(u *unstructured.Unstructured, err error, subresources []string) (*unstructured.Unstructured, error) {
+	if err == nil && len(subresources) == 0 && u != nil {
+		d.result = u
+		d.deleted = false
+	}
+	return u, err
+}
+
+func (d *dryRunResourceInterface) Create(ctx context.Context, obj *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	options.DryRun = []string{metav1.DryRunAll}
+	u, err := d.ResourceInterface.Create(ctx, obj, options, subresources...)
+	return d.record(u, err, subresources)
+}
+
+func (d *dryRunResourceInterface) Update(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	options.DryRun = []string{metav1.DryRunAll}
+	u, err := d.ResourceInterface.Update(ctx, obj, options, subresources...)
+	return d.record(u, err, subresources)
+}
+
+func (d *dryRunResourceInterface) UpdateStatus(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+	options.DryRun = []string{metav1.DryRunAll}
+	return d.ResourceInterface.UpdateStatus(ctx, obj, options)
+}
+
+func (d *dryRunResourceInterface) Delete(ctx context.Context, name string, options metav1.DeleteOptions, subresources ...string) error {
+	options.DryRun = []string{metav1.DryRunAll}
+	err := d.ResourceInterface.Delete(ctx, name, options, subresources...)
+	if err == nil && len(subresources) == 0 {
+		d.result = nil
+		d.deleted = true
+	}
+	return err
+}
+
+func (d *dryRunResourceInterface) DeleteCollection(ctx context.Context, options metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	options.DryRun = []string{metav1.DryRunAll}
+	return d.ResourceInterface.DeleteCollection(ctx, options, listOptions)
+}
+
+func (d *dryRunResourceInterface) Patch(ctx context.Context, name string, pt apitypes.PatchType, data []byte, options metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	options.DryRun = []string{metav1.DryRunAll}
+	u, err := d.ResourceInterface.Patch(ctx, name, pt, data, options, subresources...)
+	return d.record(u, err, subresources)
+}
+
+func (d *dryRunResourceInterface) Apply(ctx context.Context, name string, obj *unstructured.Unstructured, options metav1.ApplyOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	options.DryRun = []string{metav1.DryRunAll}
+	u, err := d.ResourceInterface.Apply(ctx, name, obj, options, subresources...)
+	return d.record(u, err, subresources)
+}
+
+func (d *dryRunResourceInterface) ApplyStatus(ctx context.Context, name string, obj *unstructured.Unstructured, options metav1.ApplyOptions) (*unstructured.Unstructured, error) {
+	options.DryRun = []string{metav1.DryRunAll}
+	return d.ResourceInterface.ApplyStatus(ctx, name, obj, options)
+}
+
+// runDryRun runs the actions of all steps as server-side dry runs, one after
+// another in an order that respects their dependencies, and writes a diff per
+// object to out. Success checks are not run, as nothing is actually changed.
+func (r *Runner) runDryRun(ctx context.Context, e *execution, out io.Writer) error {
+	var errs error
+	groups := e.res.Rollout.Spec.Groups
+	for _, gi := range e.plan.groups.order() {
+		group := groups[gi]
+		fmt.Fprintf(out, "# Group: %s\n", group.Name)
+		if len(group.DependsOn) > 0 {
+			fmt.Fprintf(out, "depends on: %s\n", strings.Join(group.DependsOn, ", "))
+		}
+		if skip, err := e.skipped(e.plan.groupWhen[group]); err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+			errs = multierror.Append(errs, fmt.Errorf("group %q: %w", group.Name, err))
+			continue
+		} else if skip {
+			fmt.Fprintf(out, "skipped: %s\n", group.When)
+			continue
+		}
+
+		for _, si := range e.plan.steps[gi].order() {
+			step := group.Steps[si]
+			stepName := stepName(step)
+			if step.Gate != nil {
+				fmt.Fprintf(out, "## Step: %s (Gate)\n", stepName)
+			} else {
+				fmt.Fprintf(out, "## Step: %s (%s %s)\n", stepName, step.Action, step.Object)
+			}
+			if len(step.DependsOn) > 0 {
+				fmt.Fprintf(out, "depends on: %s\n", strings.Join(step.DependsOn, ", "))
+			}
+			if cluster := stepCluster(group, step); cluster != "" && step.Gate == nil {
+				fmt.Fprintf(out, "cluster: %s\n", cluster)
+			}
+			if skip, err := e.skipped(e.plan.stepWhen[step]); err != nil {
+				fmt.Fprintf(out, "error: %v\n", err)
+				errs = multierror.Append(errs, fmt.Errorf("group %q, step %q: %w", group.Name, stepName, err))
+				continue
+			} else if skip {
+				fmt.Fprintf(out, "skipped: %s\n", step.When)
+				continue
+			}
+			if step.Gate != nil {
+				fmt.Fprintf(out, "gate, not waiting for approval\n")
+				continue
+			}
+
+			if err := r.dryRunStep(ctx, e, group, step, out); err != nil {
+				fmt.Fprintf(out, "error: %v\n", err)
+				errs = multierror.Append(errs, fmt.Errorf("group %q, step %q: %w", group.Name, stepName, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+func (r *Runner) dryRunStep(ctx context.Context, e *execution, group *types.RolloutGroup, step *types.Step, out io.Writer) error {
+	object, found := e.res.Objects[step.Object]
+	if !found {
+		return fmt.Errorf("could not find object named %q", step.Object)
+	}
+
+	cl, err := r.cluster(stepCluster(group, step))
+	if err != nil {
+		return err
+	}
+
+	action, err := r.objectAction(step.Action)
+	if err != nil {
+		return err
+	}
+
+	dryRun := func(rc *client.ResourceClient, u *unstructured.Unstructured, change func(*client.ResourceClient) error) error {
+		return dryRunChange(ctx, rc, u, out, change)
+	}
+
+	return eachObject(object, func(u *unstructured.Unstructured) error {
+		if cl.name != "" {
+			u = foreignObject(e.config, u)
+		}
+		rc, err := cl.client.ClientForUnstructured(u)
+		if err != nil {
+			return err
+		}
+		rc = rc.WithIgnoreDifferences(ignoreDifferences(e.res.Rollout.Spec, step)...)
+
+		if da, ok := action.(DryRunStepObjectAction); ok {
+			s := &StepContext{
+				Logger: r.logger,
+				Group:  group.Name,
+				Step:   step,
+				Client: cl.client,
+				Checks: cl.checks,
+			}
+			if err := da.DryRunStep(ctx, s, rc, u.DeepCopy(), dryRun); err != nil {
+				return fmt.Errorf("dry run %s: %w", objectKey(u), err)
+			}
+			return nil
+		}
+
+		return dryRun(rc, u, func(rc *client.ResourceClient) error {
+			return action.Execute(ctx, rc, u.DeepCopy())
+		})
+	})
+}
+
+// dryRunChange runs the change of the object as a server-side dry run, and
+// writes the difference between the live object and the result to out.
+func dryRunChange(ctx context.Context, rc *client.ResourceClient, u *unstructured.Unstructured, out io.Writer, change func(*client.ResourceClient) error) error {
+	live, err := rc.Get(ctx, u.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		live = nil
+	} else if err != nil {
+		return err
+	}
+
+	ri := &dryRunResourceInterface{ResourceInterface: rc.ResourceInterface}
+	if err := change(rc.WithResourceInterface(ri)); err != nil {
+		return fmt.Errorf("dry run %s: %w", objectKey(u), err)
+	}
+
+	result := ri.result
+	if result == nil && !ri.deleted {
+		result = live
+	}
+
+	diff, err := diffObjects(objectKey(u), live, result)
+	if err != nil {
+		return err
+	}
+	if diff == "" {
+		fmt.Fprintf(out, "no changes to %s\n", objectKey(u))
+		return nil
+	}
+	fmt.Fprint(out, diff)
+
+	return nil
+}
+
+// eachObject calls fn for the object, or for each item if the object is a
+// list.
+func eachObject(u *unstructured.Unstructured, fn func(*unstructured.Unstructured) error) error {
+	if u.IsList() {
+		return u.EachListItem(func(o runtime.Object) error {
+			return eachObject(o.(*unstructured.Unstructured), fn)
+		})
+	}
+
+	return fn(u)
+}
+
+// normalizeForDiff removes fields populated by the API server that are of no
+// interest when comparing objects.
+func normalizeForDiff(u *unstructured.Unstructured) *unstructured.Unstructured {
+	if u == nil {
+		return nil
+	}
+
+	u = u.DeepCopy()
+	for _, field := range []string{"managedFields", "resourceVersion", "generation", "uid", "creationTimestamp", "selfLink"} {
+		unstructured.RemoveNestedField(u.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(u.Object, "status")
+
+	return u
+}
+
+func toYAML(u *unstructured.Unstructured) (string, error) {
+	if u == nil {
+		return "", nil
+	}
+
+	b, err := json.Marshal(u.Object)
+	if err != nil {
+		return "", err
+	}
+	b, err = yaml.JSONToYAML(b)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// diffObjects returns a unified diff between the two objects, or an empty
+// string if there is no difference. A nil object is treated as not existing.
+func diffObjects(key string, from, to *unstructured.Unstructured) (string, error) {
+	a, err := toYAML(normalizeForDiff(from))
+	if err != nil {
+		return "", err
+	}
+	b, err := toYAML(normalizeForDiff(to))
+	if err != nil {
+		return "", err
+	}
+	if a == b {
+		return "", nil
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(a),
+		B:        difflib.SplitLines(b),
+		FromFile: "live/" + key,
+		ToFile:   "dry-run/" + key,
+		Context:  3,
+	})
+}
@@ -0,0 +1,36 @@
+package rollout
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffObjects(t *testing.T) {
+	live := configMap("test", "old")
+	live.SetResourceVersion("1")
+	live.SetUID("abc")
+
+	updated := configMap("test", "new")
+	updated.SetResourceVersion("2")
+
+	diff, err := diffObjects("v1/ConfigMap/default/test", live, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"--- live/v1/ConfigMap/default/test", "-  key: old", "+  key: new"} {
+		if !strings.Contains(diff, expected) {
+			t.Fatalf("expected diff to contain %q, got:\n%s", expected, diff)
+		}
+	}
+	if strings.Contains(diff, "resourceVersion") || strings.Contains(diff, "uid") {
+		t.Fatalf("expected server populated fields to be ignored, got:\n%s", diff)
+	}
+
+	diff, err = diffObjects("v1/ConfigMap/default/test", live, configMap("test", "old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "" {
+		t.Fatalf("expected no diff, got:\n%s", diff)
+	}
+}
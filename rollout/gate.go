@@ -0,0 +1,332 @@
+package rollout
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/brancz/locutus/db"
+	"github.com/brancz/locutus/feedback"
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+var (
+	gatePollInterval = 10 * time.Second
+
+	ErrGateNotPending = errors.New("gate is not pending")
+)
+
+// PendingGate is a gate waiting for approval.
+type PendingGate struct {
+	// Key is the trigger key of the execution the gate belongs to.
+	Key string `json:"key"`
+	// Gate is the name of the gate, in the form group/step.
+	Gate  string    `json:"gate"`
+	Since time.Time `json:"since"`
+}
+
+// Approvals tracks the gates currently waiting for approval, so that they
+// can be approved through HTTP.
+type Approvals struct {
+	mtx     sync.Mutex
+	pending map[PendingGate]chan string
+}
+
+func NewApprovals() *Approvals {
+	return &Approvals{
+		pending: map[PendingGate]chan string{},
+	}
+}
+
+// wait registers the gate as pending, the returned channel receives the
+// approver once it is approved. done must be called once the gate is no
+// longer waiting.
+func (a *Approvals) wait(key, gate string) (<-chan string, func()) {
+	p := PendingGate{Key: key, Gate: gate, Since: time.Now()}
+	ch := make(chan string, 1)
+
+	a.mtx.Lock()
+	a.pending[p] = ch
+	a.mtx.Unlock()
+
+	return ch, func() {
+		a.mtx.Lock()
+		delete(a.pending, p)
+		a.mtx.Unlock()
+	}
+}
+
+// Approve approves the pending gate of the execution with the trigger key.
+func (a *Approvals) Approve(key, gate, by string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for p, ch := range a.pending {
+		if p.Key != key || p.Gate != gate {
+			continue
+		}
+		select {
+		case ch <- by:
+		default:
+			// Already approved.
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: gate %q of %q", ErrGateNotPending, gate, key)
+}
+
+// Pending returns the gates currently waiting for approval.
+func (a *Approvals) Pending() []PendingGate {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	pending := make([]PendingGate, 0, len(a.pending))
+	for p := range a.pending {
+		pending = append(pending, p)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Since.Before(pending[j].Since)
+	})
+
+	return pending
+}
+
+// ApprovalHandler serves approvals over HTTP. Requests must carry one of its
+// tokens as bearer token, which identifies the approver.
+type ApprovalHandler struct {
+	approvals *Approvals
+	// tokens maps bearer tokens to the approver they identify.
+	tokens map[string]string
+}
+
+func NewApprovalHandler(approvals *Approvals, tokens map[string]string) *ApprovalHandler {
+	return &ApprovalHandler{
+		approvals: approvals,
+		tokens:    tokens,
+	}
+}
+
+// approver returns the approver identified by the request's bearer token, or
+// an empty string if the token is unknown.
+func (h *ApprovalHandler) approver(req *http.Request) string {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return ""
+	}
+
+	approver := ""
+	for t, by := range h.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			approver = by
+		}
+	}
+	return approver
+}
+
+// ServeHTTP lists pending gates on GET, and approves a gate on POST, given
+// the "key" and "gate" form values, in the name of the token's approver.
+func (h *ApprovalHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	by := h.approver(req)
+	if by == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.approvals.Pending())
+	case http.MethodPost:
+		key, gate := req.FormValue("key"), req.FormValue("gate")
+		if gate == "" {
+			http.Error(w, "gate is required", http.StatusBadRequest)
+			return
+		}
+		if err := h.approvals.Approve(key, gate, by); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// renderRevision identifies the objects and rollout of a render result.
+func renderRevision(res *render.Result) (string, error) {
+	h := sha256.New()
+	if err := json.NewEncoder(h).Encode(res); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// runGate blocks until the gate of the step is approved, or its timeout
+// expired.
+//
+// An annotation approves the gate only for the revision of the render result
+// it names, in the form <approver>@<revision>. Setting the annotation changes
+// the triggering resource, which usually supersedes the waiting execution,
+// the next execution rendering the same revision then passes the gate right
+// away. Once the rendered objects change, the annotation no longer approves.
+func (r *Runner) runGate(ctx context.Context, e *execution, groupName string, step *types.Step) error {
+	gate := step.Gate
+	name := groupName + "/" + stepName(step)
+	condition := "gate/" + name
+
+	message := "waiting for approval"
+	revision := ""
+	if gate.Annotation != "" {
+		if e.config == nil || e.config.Object == nil {
+			return fmt.Errorf("gate %q: annotation approval requires a triggering resource", name)
+		}
+		var err error
+		revision, err = renderRevision(e.res)
+		if err != nil {
+			return fmt.Errorf("gate %q: %w", name, err)
+		}
+		message = fmt.Sprintf("waiting for approval of revision %s", revision)
+	}
+
+	if gate.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gate.Timeout.Duration)
+		defer cancel()
+	}
+
+	var approved <-chan string
+	if r.approvals != nil {
+		var done func()
+		approved, done = r.approvals.wait(executionKey(e.config, e.res), name)
+		defer done()
+	}
+
+	if err := e.setConditionMessage(ctx, condition, feedback.StatusConditionInProgress, message); err != nil {
+		return err
+	}
+	level.Info(r.logger).Log("msg", "waiting for approval", "gate", name, "revision", revision)
+
+	for {
+		by, err := r.gateApprover(ctx, e, gate, revision)
+		if err != nil {
+			level.Warn(r.logger).Log("msg", "failed to check gate approval", "gate", name, "err", err)
+		}
+		if by != "" {
+			return r.approveGate(ctx, e, name, by)
+		}
+
+		select {
+		case by := <-approved:
+			return r.approveGate(ctx, e, name, by)
+		case <-ctx.Done():
+			msg := "cancelled before approval"
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				msg = fmt.Sprintf("not approved within %s", gate.Timeout.Duration)
+			}
+			// The context is done, so the status is set with a cleanup
+			// context.
+			cleanupCtx, cancel := cleanupContext()
+			err := e.setConditionMessage(cleanupCtx, condition, feedback.StatusConditionFailed, msg)
+			cancel()
+			if err != nil {
+				level.Warn(r.logger).Log("msg", "failed to set feedback condition", "condition", condition, "err", err)
+			}
+			return fmt.Errorf("gate %q %s: %w", name, msg, ctx.Err())
+		case <-time.After(gatePollInterval):
+		}
+	}
+}
+
+func (r *Runner) approveGate(ctx context.Context, e *execution, name, by string) error {
+	level.Info(r.logger).Log("msg", "gate approved", "gate", name, "by", by)
+	return e.setConditionMessage(ctx, "gate/"+name, feedback.StatusConditionFinished, "approved by "+by)
+}
+
+// gateApprover returns who approved the gate through any of its sources, or
+// an empty string if it isn't approved yet. The annotation must approve the
+// given revision.
+func (r *Runner) gateApprover(ctx context.Context, e *execution, gate *types.Gate, revision string) (string, error) {
+	if gate.Annotation != "" {
+		obj := e.config.Object
+		rc, err := r.client.ClientForUnstructured(obj)
+		if err != nil {
+			return "", err
+		}
+		live, err := rc.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		if by := annotationApprover(live.GetAnnotations()[gate.Annotation], revision); by != "" {
+			return by, nil
+		}
+	}
+
+	if gate.Database != nil {
+		return r.databaseApprover(ctx, gate.Database)
+	}
+
+	return "", nil
+}
+
+// annotationApprover returns the approver of an annotation value in the form
+// <approver>@<revision>, if it approves the revision.
+func annotationApprover(value, revision string) string {
+	i := strings.LastIndex(value, "@")
+	if i <= 0 || value[i+1:] != revision {
+		return ""
+	}
+	return value[:i]
+}
+
+func (r *Runner) databaseApprover(ctx context.Context, gate *types.DatabaseGate) (string, error) {
+	if r.databaseConnections == nil {
+		return "", fmt.Errorf("database connection %s not found", gate.DatabaseName)
+	}
+	conn, ok := r.databaseConnections.Connections[gate.DatabaseName]
+	if !ok {
+		return "", fmt.Errorf("database connection %s not found", gate.DatabaseName)
+	}
+
+	switch conn.Type {
+	case db.TypeCockroachDB:
+		by := ""
+		err := conn.CockroachClient.ExecuteTx(ctx, pgx.TxOptions{}, func(tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, gate.Query.Stmt)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			if !rows.Next() {
+				return rows.Err()
+			}
+			values, err := rows.Values()
+			if err != nil {
+				return err
+			}
+			by = gate.DatabaseName
+			if len(values) > 0 && values[0] != nil {
+				by = fmt.Sprintf("%v", values[0])
+			}
+			return nil
+		})
+		return by, err
+	default:
+		return "", fmt.Errorf("database type %s not supported", conn.Type)
+	}
+}
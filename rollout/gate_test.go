@@ -0,0 +1,145 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/feedback"
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+type messageFeedback struct {
+	mtx      sync.Mutex
+	messages map[string]string
+}
+
+func (f *messageFeedback) Initialize(ctx context.Context, groups []string) error { return nil }
+
+func (f *messageFeedback) SetCondition(ctx context.Context, name string, status feedback.CurrentStatus) error {
+	return nil
+}
+
+func (f *messageFeedback) SetConditionMessage(ctx context.Context, name string, status feedback.CurrentStatus, message string) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.messages[name] = message
+	return nil
+}
+
+func TestGateApprovedThroughHTTP(t *testing.T) {
+	approvals := NewApprovals()
+	r := &Runner{logger: log.NewNopLogger(), approvals: approvals}
+	recorder := &messageFeedback{messages: map[string]string{}}
+	e := &execution{
+		res:    &render.Result{},
+		config: &Config{Key: "default/test", Feedback: recorder},
+	}
+	step := &types.Step{Name: "approve-migration", Gate: &types.Gate{}}
+
+	errs := make(chan error)
+	go func() {
+		errs <- r.runGate(context.Background(), e, "database", step)
+	}()
+
+	for len(approvals.Pending()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	pending := approvals.Pending()[0]
+	if pending.Key != "default/test" || pending.Gate != "database/approve-migration" {
+		t.Fatalf("unexpected pending gate %+v", pending)
+	}
+
+	h := NewApprovalHandler(approvals, map[string]string{"secret": "jane"})
+	post := func(form url.Values, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/gates", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	form := url.Values{"key": {"default/test"}, "gate": {"database/approve-migration"}, "by": {"mallory"}}
+	if code := post(form, "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("expected approving with an unknown token to fail, got status %d", code)
+	}
+
+	form.Set("gate", "database/unknown")
+	if code := post(form, "secret"); code != http.StatusNotFound {
+		t.Fatalf("expected approving an unknown gate to fail, got status %d", code)
+	}
+
+	form.Set("gate", "database/approve-migration")
+	if code := post(form, "secret"); code != http.StatusAccepted {
+		t.Fatalf("expected gate to be approved, got status %d", code)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(recorder.messages["gate/database/approve-migration"], "approved by jane") {
+		t.Fatalf("expected the token's approver to be recorded, got %q", recorder.messages["gate/database/approve-migration"])
+	}
+	if len(approvals.Pending()) != 0 {
+		t.Fatal("expected no pending gates after approval")
+	}
+}
+
+func TestGateTimeout(t *testing.T) {
+	r := &Runner{logger: log.NewNopLogger()}
+	e := &execution{res: &render.Result{}}
+	step := &types.Step{Name: "approve", Gate: &types.Gate{
+		Timeout: types.Duration{Duration: 10 * time.Millisecond},
+	}}
+
+	err := r.runGate(context.Background(), e, "main", step)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected gate to time out, got: %v", err)
+	}
+}
+
+func TestAnnotationApprovalIsBoundToRevision(t *testing.T) {
+	res := &render.Result{Objects: map[string]*unstructured.Unstructured{
+		"cm": configMap("test", "v1"),
+	}}
+	revision, err := renderRevision(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := renderRevision(res); again != revision {
+		t.Fatalf("expected the revision of the same render result to be stable, got %q and %q", revision, again)
+	}
+
+	changed := &render.Result{Objects: map[string]*unstructured.Unstructured{
+		"cm": configMap("test", "v2"),
+	}}
+	changedRevision, err := renderRevision(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changedRevision == revision {
+		t.Fatal("expected changed objects to change the revision")
+	}
+
+	value := "jane@example.com@" + revision
+	if by := annotationApprover(value, revision); by != "jane@example.com" {
+		t.Fatalf("expected the annotation to approve its revision, got %q", by)
+	}
+	if by := annotationApprover(value, changedRevision); by != "" {
+		t.Fatalf("expected the annotation not to approve another revision, got %q", by)
+	}
+	if by := annotationApprover("jane", revision); by != "" {
+		t.Fatalf("expected an annotation without revision not to approve, got %q", by)
+	}
+}
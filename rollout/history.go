@@ -0,0 +1,323 @@
+package rollout
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+const (
+	// HistoryLabel is set on history Secrets, its value identifies the
+	// trigger key the history belongs to.
+	HistoryLabel = "locutus.io/history"
+
+	DefaultHistoryRevisionLimit = 10
+
+	// historyMaxSize bounds the encoded entries of a history Secret, which
+	// must stay below the 1MiB limit of Secrets including their metadata.
+	historyMaxSize = 900 * 1024
+
+	historyKeyDataKey     = "key"
+	historyEntriesDataKey = "entries"
+)
+
+// HistoryConfig configures recording a history of executions per trigger
+// key.
+type HistoryConfig struct {
+	Enabled bool
+	// RevisionLimit is the number of entries kept per trigger key, older
+	// entries are removed.
+	RevisionLimit int
+	// Namespace is the namespace history Secrets are stored in.
+	Namespace string
+}
+
+// HistoryEntry records a single execution.
+type HistoryEntry struct {
+	Revision int            `json:"revision"`
+	Start    time.Time      `json:"start"`
+	Duration types.Duration `json:"duration"`
+	// InputHash is the hash of the configuration passed to the renderer and
+	// of the render result, so that it also changes with the renderer's
+	// sources, such as jsonnet files.
+	InputHash string `json:"inputHash"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+	// Render is the gzip compressed JSON encoded render result.
+	Render []byte         `json:"render,omitempty"`
+	Steps  []*StepHistory `json:"steps,omitempty"`
+}
+
+// StepHistory records the outcome of a single step.
+type StepHistory struct {
+	Group    string         `json:"group"`
+	Step     string         `json:"step"`
+	Object   string         `json:"object"`
+	Action   string         `json:"action"`
+	Result   string         `json:"result"`
+	Duration types.Duration `json:"duration"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// RenderResult decompresses the render result recorded in the entry.
+func (h *HistoryEntry) RenderResult() (*render.Result, error) {
+	if len(h.Render) == 0 {
+		return nil, nil
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(h.Render))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	res := &render.Result{}
+	if err := json.NewDecoder(gr).Decode(res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func compressRenderResult(res *render.Result) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	if err := json.NewEncoder(gw).Encode(res); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func inputHash(rawConfig []byte, res *render.Result) (string, error) {
+	h := sha256.New()
+	h.Write(rawConfig)
+	if res != nil {
+		// Maps are marshalled with sorted keys, so the result is stable.
+		if err := json.NewEncoder(h).Encode(res); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// executionHistory collects the outcome of the steps of an execution, which
+// may run concurrently.
+type executionHistory struct {
+	mtx   sync.Mutex
+	start time.Time
+	steps []*StepHistory
+}
+
+func (h *executionHistory) recordStep(step *StepHistory) {
+	if h == nil {
+		return
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.steps = append(h.steps, step)
+}
+
+func historyName(id string) string {
+	return "locutus-history-" + id
+}
+
+// recordHistory adds an entry for the execution to the history of its key.
+func (r *Runner) recordHistory(ctx context.Context, config *Config, res *render.Result, h *executionHistory, execErr error) error {
+	var rawConfig []byte
+	if config != nil {
+		rawConfig = config.RawConfig
+	}
+
+	hash, err := inputHash(rawConfig, res)
+	if err != nil {
+		return fmt.Errorf("hash input: %w", err)
+	}
+	entry := &HistoryEntry{
+		Start:     h.start,
+		Duration:  types.Duration{Duration: time.Since(h.start)},
+		InputHash: hash,
+		Result:    "succeeded",
+		Steps:     h.steps,
+	}
+	if execErr != nil {
+		entry.Result = "failed"
+		entry.Error = execErr.Error()
+	}
+	if res != nil {
+		b, err := compressRenderResult(res)
+		if err != nil {
+			return fmt.Errorf("compress render result: %w", err)
+		}
+		entry.Render = b
+	}
+
+	key := executionKey(config, res)
+	secrets := r.client.KubeClient().CoreV1().Secrets(r.history.Namespace)
+	name := historyName(inventoryID(key))
+
+	current, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		current = nil
+	} else if err != nil {
+		return fmt.Errorf("get history: %w", err)
+	}
+
+	entries := []*HistoryEntry{}
+	if current != nil {
+		if entries, err = decodeHistory(current); err != nil {
+			return err
+		}
+	}
+
+	entry.Revision = 1
+	if len(entries) > 0 {
+		entry.Revision = entries[len(entries)-1].Revision + 1
+	}
+	entries = append(entries, entry)
+
+	limit := r.history.RevisionLimit
+	if limit <= 0 {
+		limit = DefaultHistoryRevisionLimit
+	}
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	b, err := encodeHistory(entries)
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: r.history.Namespace,
+			Labels: map[string]string{
+				HistoryLabel: inventoryID(key),
+			},
+		},
+		Data: map[string][]byte{
+			historyKeyDataKey:     []byte(key),
+			historyEntriesDataKey: b,
+		},
+	}
+
+	if current == nil {
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+
+	secret.ResourceVersion = current.ResourceVersion
+	_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+// encodeHistory encodes the entries, removing the oldest ones until they fit
+// into a Secret. Should the newest entry not fit by itself, its render result
+// is dropped.
+func encodeHistory(entries []*HistoryEntry) ([]byte, error) {
+	for {
+		b, err := json.Marshal(entries)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) <= historyMaxSize {
+			return b, nil
+		}
+		switch {
+		case len(entries) > 1:
+			entries = entries[1:]
+		case len(entries[0].Render) > 0:
+			entries[0].Render = nil
+		default:
+			return nil, fmt.Errorf("history entry of %d bytes exceeds the limit of %d bytes", len(b), historyMaxSize)
+		}
+	}
+}
+
+func decodeHistory(secret *corev1.Secret) ([]*HistoryEntry, error) {
+	entries := []*HistoryEntry{}
+	if err := json.Unmarshal(secret.Data[historyEntriesDataKey], &entries); err != nil {
+		return nil, fmt.Errorf("parse history: %w", err)
+	}
+	return entries, nil
+}
+
+// ReadHistory returns the recorded executions for the trigger key, oldest
+// first.
+func ReadHistory(ctx context.Context, kclient kubernetes.Interface, namespace, key string) ([]*HistoryEntry, error) {
+	secret, err := kclient.CoreV1().Secrets(namespace).Get(ctx, historyName(inventoryID(key)), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get history: %w", err)
+	}
+
+	return decodeHistory(secret)
+}
+
+// HistoryKeys returns the trigger keys a history is recorded for.
+func HistoryKeys(ctx context.Context, kclient kubernetes.Interface, namespace string) ([]string, error) {
+	list, err := kclient.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: HistoryLabel,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list histories: %w", err)
+	}
+
+	keys := make([]string, 0, len(list.Items))
+	for _, s := range list.Items {
+		keys = append(keys, string(s.Data[historyKeyDataKey]))
+	}
+
+	return keys, nil
+}
+
+// PrintHistory writes a summary of the entries to out.
+func PrintHistory(out io.Writer, entries []*HistoryEntry) {
+	fmt.Fprintf(out, "REVISION\tSTART\tDURATION\tRESULT\tINPUT HASH\tERROR\n")
+	for _, e := range entries {
+		hash := e.InputHash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\t%s\n", e.Revision, e.Start.Format(time.RFC3339), e.Duration.Duration, e.Result, hash, e.Error)
+	}
+}
+
+// PrintHistoryEntry writes the outcome of each step of the entry to out.
+func PrintHistoryEntry(out io.Writer, e *HistoryEntry) {
+	fmt.Fprintf(out, "Revision:   %d\n", e.Revision)
+	fmt.Fprintf(out, "Start:      %s\n", e.Start.Format(time.RFC3339))
+	fmt.Fprintf(out, "Duration:   %s\n", e.Duration.Duration)
+	fmt.Fprintf(out, "Input hash: %s\n", e.InputHash)
+	fmt.Fprintf(out, "Result:     %s\n", e.Result)
+	if e.Error != "" {
+		fmt.Fprintf(out, "Error:      %s\n", e.Error)
+	}
+	fmt.Fprintf(out, "\nGROUP\tSTEP\tACTION\tOBJECT\tRESULT\tDURATION\tERROR\n")
+	for _, s := range e.Steps {
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Group, s.Step, s.Action, s.Object, s.Result, s.Duration.Duration, s.Error)
+	}
+}
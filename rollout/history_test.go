@@ -0,0 +1,123 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+func TestRecordHistory(t *testing.T) {
+	ctx := context.Background()
+	kc := kubefake.NewSimpleClientset()
+	r := &Runner{
+		logger: log.NewNopLogger(),
+		client: client.NewClient(nil, kc),
+		history: HistoryConfig{
+			Enabled:       true,
+			RevisionLimit: 2,
+			Namespace:     "default",
+		},
+	}
+
+	config := &Config{Key: "default/test", RawConfig: []byte(`{"replicas":1}`)}
+	res := &render.Result{
+		Objects: map[string]*unstructured.Unstructured{"cm": configMap("cm", "value")},
+		Rollout: &types.Rollout{Metadata: &types.Metadata{Name: "test"}},
+	}
+
+	for i := 0; i < 3; i++ {
+		h := &executionHistory{start: time.Now()}
+		h.recordStep(&StepHistory{Group: "main", Step: "cm", Result: "succeeded"})
+
+		var execErr error
+		if i == 2 {
+			execErr = errors.New("step failed")
+		}
+		if err := r.recordHistory(ctx, config, res, h, execErr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ReadHistory(ctx, kc, "default", "default/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected history to be trimmed to 2 entries, got %d", len(entries))
+	}
+	if entries[0].Revision != 2 || entries[1].Revision != 3 {
+		t.Fatalf("expected revisions 2 and 3, got %d and %d", entries[0].Revision, entries[1].Revision)
+	}
+	if entries[1].Result != "failed" || entries[1].Error != "step failed" {
+		t.Fatalf("unexpected result %q with error %q", entries[1].Result, entries[1].Error)
+	}
+	if hash, _ := inputHash(config.RawConfig, res); entries[1].InputHash != hash {
+		t.Fatalf("unexpected input hash %q", entries[1].InputHash)
+	}
+	if len(entries[1].Steps) != 1 || entries[1].Steps[0].Step != "cm" {
+		t.Fatalf("unexpected steps %v", entries[1].Steps)
+	}
+
+	recorded, err := entries[1].RenderResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded.Objects["cm"].GetName() != "cm" {
+		t.Fatalf("unexpected render result %v", recorded)
+	}
+
+	keys, err := HistoryKeys(ctx, kc, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "default/test" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestEncodeHistoryTrimsBySize(t *testing.T) {
+	large := make([]byte, historyMaxSize/2)
+	entries := []*HistoryEntry{
+		{InputHash: "a", Render: large},
+		{InputHash: "b", Render: large},
+		{InputHash: "c", Render: large},
+	}
+
+	b, err := encodeHistory(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > historyMaxSize {
+		t.Fatalf("expected at most %d bytes, got %d", historyMaxSize, len(b))
+	}
+	var decoded []*HistoryEntry
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0].InputHash != "c" || len(decoded[0].Render) != len(large) {
+		t.Fatalf("expected only the newest entry, got %d entries", len(decoded))
+	}
+
+	// An entry that does not fit by itself loses its render result.
+	b, err = encodeHistory([]*HistoryEntry{{InputHash: "d", Render: make([]byte, historyMaxSize)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var single []*HistoryEntry
+	if err := json.Unmarshal(b, &single); err != nil {
+		t.Fatal(err)
+	}
+	if len(single) != 1 || len(single[0].Render) != 0 {
+		t.Fatal("expected the render result to be dropped")
+	}
+}
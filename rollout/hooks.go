@@ -0,0 +1,268 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/feedback"
+	"github.com/brancz/locutus/rollout/checks"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+const (
+	DefaultHookTimeout = 10 * time.Minute
+
+	// hookLogTailLines is the number of log lines captured per container
+	// of a failed hook.
+	hookLogTailLines = int64(20)
+)
+
+var (
+	hookPollInterval = 2 * time.Second
+)
+
+// HookFailedError is returned when a hook's Job failed, it carries the tail
+// of the logs of the Job's pods.
+type HookFailedError struct {
+	Job    string
+	Reason string
+	Logs   string
+}
+
+func (e *HookFailedError) Error() string {
+	msg := fmt.Sprintf("hook job %s failed: %s", e.Job, e.Reason)
+	if e.Logs != "" {
+		msg += "\n" + e.Logs
+	}
+	return msg
+}
+
+// runHooks runs the hooks in order, and stops at the first one failing.
+func (r *Runner) runHooks(ctx context.Context, e *execution, group *types.RolloutGroup, phase string, hooks []*types.Hook) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	cl, err := r.cluster(group.Cluster)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		condition := fmt.Sprintf("hook/%s/%s", group.Name, hook.Object)
+		if err := e.setCondition(ctx, condition, feedback.StatusConditionInProgress); err != nil {
+			return err
+		}
+
+		level.Debug(r.logger).Log("msg", "running hook", "group", group.Name, "phase", phase, "object", hook.Object, "cluster", cl.name)
+		err := r.runHook(ctx, e, cl.client, hook)
+		r.metrics.hooks.WithLabelValues(phase, hookResult(err)).Inc()
+		if err != nil {
+			r.setFailedCondition(e, condition)
+			return fmt.Errorf("%s hook %q: %w", phase, hook.Object, err)
+		}
+
+		if err := e.setCondition(ctx, condition, feedback.StatusConditionFinished); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hookResult(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "succeeded"
+}
+
+func (r *Runner) runHook(ctx context.Context, e *execution, cl *client.Client, hook *types.Hook) error {
+	object, found := e.res.Objects[hook.Object]
+	if !found {
+		return fmt.Errorf("could not find object named %q", hook.Object)
+	}
+	if object.GetKind() != "Job" {
+		return checks.ErrNotAJob
+	}
+
+	rc, err := cl.ClientForUnstructured(object)
+	if err != nil {
+		return err
+	}
+
+	policy := hook.DeletePolicy
+	if policy == "" {
+		policy = types.HookDeletePolicyBeforeCreation
+	}
+
+	if policy == types.HookDeletePolicyBeforeCreation {
+		if err := deleteAndWait(ctx, rc, object.GetName()); err != nil {
+			return fmt.Errorf("delete previous job: %w", err)
+		}
+	}
+
+	if _, err := rc.Create(ctx, object, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("create job: %w", err)
+	}
+
+	timeout := hook.Timeout.Duration
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	if err := r.waitForJob(ctx, cl, rc, object, timeout); err != nil {
+		return err
+	}
+
+	if policy == types.HookDeletePolicyOnSuccess {
+		if err := deleteIfExists(ctx, rc, object.GetName()); err != nil {
+			return fmt.Errorf("delete job: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// deleteAndWait deletes the object, and waits for it to be gone, so that it
+// can be created again.
+func deleteAndWait(ctx context.Context, rc *client.ResourceClient, name string) error {
+	if err := deleteIfExists(ctx, rc, name); err != nil {
+		return err
+	}
+
+	for {
+		_, err := rc.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(hookPollInterval):
+		}
+	}
+}
+
+// waitForJob polls the Job until it completed or failed.
+func (r *Runner) waitForJob(ctx context.Context, cl *client.Client, rc *client.ResourceClient, job *unstructured.Unstructured, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		u, err := rc.Get(ctx, job.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("get job: %w", err)
+		}
+
+		done, reason := jobFinished(u)
+		if done && reason == "" {
+			return nil
+		}
+		if done {
+			return &HookFailedError{
+				Job:    job.GetName(),
+				Reason: reason,
+				Logs:   r.jobLogs(ctx, cl, job),
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			// The context is done, so logs are fetched with a cleanup
+			// context.
+			lctx, cancel := cleanupContext()
+			defer cancel()
+			return &HookFailedError{
+				Job:    job.GetName(),
+				Reason: fmt.Sprintf("not completed within %s", timeout),
+				Logs:   r.jobLogs(lctx, cl, job),
+			}
+		case <-time.After(hookPollInterval):
+		}
+	}
+}
+
+// jobFinished returns whether the Job has finished, and the reason it failed
+// if it didn't complete.
+func jobFinished(u *unstructured.Unstructured) (bool, string) {
+	conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["status"] != string(corev1.ConditionTrue) {
+			continue
+		}
+
+		switch condition["type"] {
+		case "Complete":
+			return true, ""
+		case "Failed":
+			reason, _ := condition["reason"].(string)
+			message, _ := condition["message"].(string)
+			if reason == "" {
+				reason = "Failed"
+			}
+			if message != "" {
+				reason += ": " + message
+			}
+			return true, reason
+		}
+	}
+
+	return false, ""
+}
+
+// jobLogs returns the tail of the logs of all containers of the Job's pods.
+// Errors are logged rather than returned, as the logs only add context to
+// the hook's failure.
+func (r *Runner) jobLogs(ctx context.Context, cl *client.Client, job *unstructured.Unstructured) string {
+	namespace := job.GetNamespace()
+	if namespace == "" {
+		var err error
+		namespace, err = cl.ObjectNamespace(job)
+		if err != nil {
+			level.Warn(r.logger).Log("msg", "failed to resolve namespace of hook job", "job", job.GetName(), "err", err)
+			return ""
+		}
+	}
+	pods := cl.KubeClient().CoreV1().Pods(namespace)
+	list, err := pods.List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("job-name=%s", job.GetName()),
+	})
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed to list pods of hook job", "job", job.GetName(), "err", err)
+		return ""
+	}
+
+	tailLines := hookLogTailLines
+	b := strings.Builder{}
+	for _, pod := range list.Items {
+		for _, container := range pod.Spec.Containers {
+			logs, err := pods.GetLogs(pod.Name, &corev1.PodLogOptions{
+				Container: container.Name,
+				TailLines: &tailLines,
+			}).DoRaw(ctx)
+			if err != nil {
+				level.Warn(r.logger).Log("msg", "failed to get logs of hook job", "job", job.GetName(), "pod", pod.Name, "container", container.Name, "err", err)
+				continue
+			}
+
+			level.Info(r.logger).Log("msg", "hook job failed", "job", job.GetName(), "pod", pod.Name, "container", container.Name, "logs", string(logs))
+			fmt.Fprintf(&b, "==> %s/%s <==\n%s", pod.Name, container.Name, logs)
+		}
+	}
+
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,148 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/feedback"
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+func job(name string, conditions ...interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "batch/v1",
+			"kind":       "Job",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "default",
+			},
+			"status": map[string]interface{}{
+				"conditions": conditions,
+			},
+		},
+	}
+}
+
+func jobCondition(conditionType, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":   conditionType,
+		"status": "True",
+		"reason": reason,
+	}
+}
+
+func TestJobFinished(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		job    *unstructured.Unstructured
+		done   bool
+		reason string
+	}{
+		{name: "running", job: job("test")},
+		{name: "complete", job: job("test", jobCondition("Complete", "")), done: true},
+		{name: "failed", job: job("test", jobCondition("Failed", "BackoffLimitExceeded")), done: true, reason: "BackoffLimitExceeded"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			done, reason := jobFinished(tc.job)
+			if done != tc.done || reason != tc.reason {
+				t.Fatalf("expected (%t, %q), got (%t, %q)", tc.done, tc.reason, done, reason)
+			}
+		})
+	}
+}
+
+func TestWaitForJobCapturesLogs(t *testing.T) {
+	ctx := context.Background()
+	failed := job("migrate", jobCondition("Failed", "BackoffLimitExceeded"))
+
+	gvr := schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), failed)
+	rc := &client.ResourceClient{ResourceInterface: dc.Resource(gvr).Namespace("default")}
+
+	kc := kubefake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "migrate-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{"job-name": "migrate"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "migrate"}},
+		},
+	})
+	r := &Runner{logger: log.NewNopLogger(), client: client.NewClient(nil, kc)}
+
+	err := r.waitForJob(ctx, r.client, rc, failed, time.Minute)
+	var hookErr *HookFailedError
+	if !errors.As(err, &hookErr) {
+		t.Fatalf("expected hook failed error, got: %v", err)
+	}
+	if hookErr.Reason != "BackoffLimitExceeded" {
+		t.Fatalf("unexpected reason %q", hookErr.Reason)
+	}
+	if !strings.Contains(hookErr.Logs, "==> migrate-abcde/migrate <==") {
+		t.Fatalf("expected logs of the job's pod, got:\n%s", hookErr.Logs)
+	}
+}
+
+// statusFeedback records the status of conditions, unless they are set with a
+// done context, like feedback written to the API server.
+type statusFeedback struct {
+	mtx      sync.Mutex
+	statuses map[string]feedback.CurrentStatus
+}
+
+func (f *statusFeedback) Initialize(ctx context.Context, groups []string) error { return nil }
+
+func (f *statusFeedback) SetCondition(ctx context.Context, name string, status feedback.CurrentStatus) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.statuses[name] = status
+	return nil
+}
+
+func (f *statusFeedback) SetConditionMessage(ctx context.Context, name string, status feedback.CurrentStatus, message string) error {
+	return f.SetCondition(ctx, name, status)
+}
+
+func TestRunHooksCancelledSetsFailedCondition(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The Job never finishes, the execution is cancelled while waiting.
+	migrate := job("migrate")
+	f := &statusFeedback{statuses: map[string]feedback.CurrentStatus{}}
+	e := &execution{
+		config: &Config{Feedback: f},
+		res:    &render.Result{Objects: map[string]*unstructured.Unstructured{"migrate": migrate}},
+	}
+	r := NewRunner(nil, log.NewNopLogger(), discoveryClient(), nil, nil, DryRunNone)
+	group := &types.RolloutGroup{Name: "main"}
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err := r.runHooks(ctx, e, group, "pre", []*types.Hook{{Object: "migrate"}})
+	if err == nil {
+		t.Fatal("expected the hook to fail")
+	}
+	if s := f.statuses["hook/main/migrate"]; s != feedback.StatusConditionFailed {
+		t.Fatalf("expected the hook's condition to be failed, got %q", s)
+	}
+}
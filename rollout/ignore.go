@@ -0,0 +1,24 @@
+package rollout
+
+import (
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// ignoreDifferences returns the fields kept as they are in the cluster when
+// the step's object is updated, those of the rollout followed by those of the
+// step.
+func ignoreDifferences(spec *types.RolloutSpec, step *types.Step) []*client.IgnoreDifferences {
+	ignores := []*client.IgnoreDifferences{}
+	for _, list := range [][]*types.IgnoreDifference{spec.IgnoreDifferences, step.IgnoreDifferences} {
+		for _, d := range list {
+			ignores = append(ignores, &client.IgnoreDifferences{
+				Group:        d.Group,
+				Kind:         d.Kind,
+				JSONPointers: d.JSONPointers,
+				JSONPaths:    d.JSONPaths,
+			})
+		}
+	}
+	return ignores
+}
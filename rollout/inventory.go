@@ -0,0 +1,479 @@
+package rollout
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/cel-go/cel"
+	"github.com/hashicorp/go-multierror"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apitypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+const (
+	// InventoryLabel is set on all applied objects and the inventory
+	// itself, its value identifies the inventory the objects belong to.
+	InventoryLabel = "locutus.io/inventory"
+
+	inventoryKeyDataKey     = "key"
+	inventoryObjectsDataKey = "objects"
+)
+
+// PruneConfig configures deleting objects that were applied by an earlier
+// execution, but are no longer rendered.
+type PruneConfig struct {
+	// Enabled turns on tracking applied objects in an inventory per trigger
+	// key, and pruning objects no longer rendered.
+	Enabled bool
+	// DryRun only logs the objects that would be pruned.
+	DryRun bool
+	// AllowedKinds restricts pruning to the given kinds. All kinds are
+	// pruned if empty.
+	AllowedKinds []schema.GroupKind
+	// Namespace is the namespace inventories are stored in.
+	Namespace string
+}
+
+func (c PruneConfig) allowed(gk schema.GroupKind) bool {
+	if len(c.AllowedKinds) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedKinds {
+		if allowed == gk {
+			return true
+		}
+	}
+	return false
+}
+
+type inventoryRef struct {
+	// Cluster is the name of the cluster the object was rolled out to,
+	// empty for the cluster locutus runs against.
+	Cluster    string `json:"cluster,omitempty"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+// newInventoryRef returns the reference to the object in the namespace it is
+// placed in, as returned by client.ObjectNamespace.
+func newInventoryRef(cluster, namespace string, u *unstructured.Unstructured) inventoryRef {
+	return inventoryRef{
+		Cluster:    cluster,
+		APIVersion: u.GetAPIVersion(),
+		Kind:       u.GetKind(),
+		Namespace:  namespace,
+		Name:       u.GetName(),
+	}
+}
+
+// object returns a stub of the referenced object, to resolve its client with.
+func (r inventoryRef) object() *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(r.APIVersion)
+	u.SetKind(r.Kind)
+	u.SetNamespace(r.Namespace)
+	u.SetName(r.Name)
+	return u
+}
+
+func (r inventoryRef) String() string {
+	s := fmt.Sprintf("%s/%s/%s/%s", r.APIVersion, r.Kind, r.Namespace, r.Name)
+	if r.Cluster != "" {
+		return r.Cluster + ":" + s
+	}
+	return s
+}
+
+func (r inventoryRef) groupKind() schema.GroupKind {
+	return schema.FromAPIVersionAndKind(r.APIVersion, r.Kind).GroupKind()
+}
+
+// inventoryKey returns the key identifying the inventory of an execution.
+func inventoryKey(e *execution) string {
+	return executionKey(e.config, e.res)
+}
+
+// executionKey returns the trigger key of an execution, falling back to the
+// name of the rollout for executions without a trigger key.
+func executionKey(config *Config, res *render.Result) string {
+	if config != nil && config.Key != "" {
+		return config.Key
+	}
+	if res != nil && res.Rollout != nil && res.Rollout.Metadata != nil {
+		return res.Rollout.Metadata.Name
+	}
+	return ""
+}
+
+// inventoryID derives an ID from the inventory key that is safe to use as a
+// label value and as part of an object name.
+func inventoryID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func inventoryName(id string) string {
+	return "locutus-inventory-" + id
+}
+
+// ownsObject returns whether objects the action is executed for are owned by
+// the rollout. Deleted objects and objects that are only patched are not.
+func ownsObject(action string) bool {
+	switch action {
+	case (&DeleteIfExistsObjectAction{}).Name(),
+		(&PatchObjectAction{PatchType: apitypes.JSONPatchType}).Name(),
+		(&PatchObjectAction{PatchType: apitypes.MergePatchType}).Name(),
+		(&PatchObjectAction{PatchType: apitypes.StrategicMergePatchType}).Name():
+		return false
+	}
+	return true
+}
+
+// appliedObjects returns the objects the action creates for the rendered
+// object. BlueGreen rolls out both colors, but never the object itself.
+func appliedObjects(action string, u *unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	if action != (&BlueGreenObjectAction{}).Name() {
+		return []*unstructured.Unstructured{u}, nil
+	}
+
+	objects := []*unstructured.Unstructured{}
+	for _, color := range []string{colorBlue, colorGreen} {
+		c, err := colored(u, color)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, c)
+	}
+	return objects, nil
+}
+
+// ownedObjects returns the rendered objects owned by the rollout's steps.
+func ownedObjects(e *execution) []*unstructured.Unstructured {
+	seen := map[string]bool{}
+	objects := []*unstructured.Unstructured{}
+	for _, group := range e.res.Rollout.Spec.Groups {
+		for _, step := range group.Steps {
+			if !ownsObject(step.Action) || seen[step.Object] {
+				continue
+			}
+			object, found := e.res.Objects[step.Object]
+			if !found {
+				continue
+			}
+			seen[step.Object] = true
+			objects = append(objects, object)
+		}
+	}
+
+	return objects
+}
+
+// labelInventoryObjects sets the inventory label on all objects owned by the
+// rollout.
+func labelInventoryObjects(e *execution, id string) error {
+	for _, object := range ownedObjects(e) {
+		err := eachObject(object, func(u *unstructured.Unstructured) error {
+			labels := u.GetLabels()
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[InventoryLabel] = id
+			u.SetLabels(labels)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stampContentHashes sets the content hash annotation on all objects owned by
+// the rollout. It must be called after all other changes to the objects.
+func stampContentHashes(e *execution) error {
+	for _, object := range ownedObjects(e) {
+		if err := eachObject(object, client.SetContentHash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runsStep returns whether neither the step nor its group are skipped by
+// their `when` expressions. Steps whose expressions fail to evaluate count as
+// run, so that their objects are not pruned because of the failure.
+func (e *execution) runsStep(group *types.RolloutGroup, step *types.Step) bool {
+	if e.plan == nil {
+		return true
+	}
+	for _, when := range []cel.Program{e.plan.groupWhen[group], e.plan.stepWhen[step]} {
+		if skip, err := e.skipped(when); err == nil && skip {
+			return false
+		}
+	}
+	return true
+}
+
+// appliedRefs returns the objects owned by the rollout's steps, in each of
+// the clusters they are rolled out to. Objects of steps skipped by `when`
+// are not applied, so objects applied by them earlier are pruned.
+func (r *Runner) appliedRefs(e *execution) (map[string]inventoryRef, error) {
+	refs := map[string]inventoryRef{}
+	for _, group := range e.res.Rollout.Spec.Groups {
+		for _, step := range group.Steps {
+			if !ownsObject(step.Action) || !e.runsStep(group, step) {
+				continue
+			}
+			object, found := e.res.Objects[step.Object]
+			if !found {
+				continue
+			}
+			cluster := stepCluster(group, step)
+			// Objects of clusters that aren't configured keep their
+			// rendered namespace, they are resolved once the cluster is
+			// configured again.
+			cl, clusterErr := r.cluster(cluster)
+			err := eachObject(object, func(u *unstructured.Unstructured) error {
+				applied, err := appliedObjects(step.Action, u)
+				if err != nil {
+					return err
+				}
+				for _, u := range applied {
+					namespace := u.GetNamespace()
+					if clusterErr == nil {
+						namespace, err = cl.client.ObjectNamespace(u)
+						if err != nil {
+							return err
+						}
+					}
+					ref := newInventoryRef(cluster, namespace, u)
+					refs[ref.String()] = ref
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+func (r *Runner) readInventory(ctx context.Context, id string) ([]inventoryRef, error) {
+	cm, err := r.client.KubeClient().CoreV1().ConfigMaps(r.prune.Namespace).Get(ctx, inventoryName(id), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get inventory: %w", err)
+	}
+
+	refs := []inventoryRef{}
+	if err := json.Unmarshal([]byte(cm.Data[inventoryObjectsDataKey]), &refs); err != nil {
+		return nil, fmt.Errorf("parse inventory: %w", err)
+	}
+
+	return refs, nil
+}
+
+func (r *Runner) writeInventory(ctx context.Context, key, id string, refs map[string]inventoryRef) error {
+	list := make([]inventoryRef, 0, len(refs))
+	for _, ref := range refs {
+		list = append(list, ref)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].String() < list[j].String()
+	})
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	cms := r.client.KubeClient().CoreV1().ConfigMaps(r.prune.Namespace)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      inventoryName(id),
+			Namespace: r.prune.Namespace,
+			Labels: map[string]string{
+				InventoryLabel: id,
+			},
+		},
+		Data: map[string]string{
+			inventoryKeyDataKey:     key,
+			inventoryObjectsDataKey: string(b),
+		},
+	}
+
+	current, err := cms.Get(ctx, cm.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = cms.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	cm.ResourceVersion = current.ResourceVersion
+	_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// staleObjects returns the objects in the inventory that are no longer
+// applied, and still carry the label of the inventory.
+func (r *Runner) staleObjects(ctx context.Context, id string, applied map[string]inventoryRef) ([]inventoryRef, error) {
+	previous, err := r.readInventory(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := []inventoryRef{}
+	for _, ref := range previous {
+		if _, ok := applied[ref.String()]; ok {
+			continue
+		}
+
+		cl, err := r.cluster(ref.Cluster)
+		if err != nil {
+			// The object is kept in the inventory, so that it is pruned
+			// should the cluster be configured again.
+			level.Warn(r.logger).Log("msg", "not pruning object", "object", ref, "err", err)
+			applied[ref.String()] = ref
+			continue
+		}
+		// Inventories written by earlier versions may hold objects
+		// without their default namespace.
+		rc, err := cl.client.ClientForUnstructured(ref.object())
+		var unknown *client.UnknownKindError
+		if errors.As(err, &unknown) {
+			// The kind may only be unavailable for now, such as the
+			// kinds of an aggregated API whose server is down, so the
+			// object is kept in the inventory like above.
+			level.Warn(r.logger).Log("msg", "not pruning object of kind no longer served", "object", ref, "err", err)
+			applied[ref.String()] = ref
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		live, err := rc.Get(ctx, ref.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if live.GetLabels()[InventoryLabel] != id {
+			level.Debug(r.logger).Log("msg", "object no longer belongs to inventory, not pruning", "object", ref)
+			continue
+		}
+
+		stale = append(stale, ref)
+	}
+
+	return stale, nil
+}
+
+// pruneObjects deletes all objects that were applied by an earlier execution
+// with the same key, but are no longer applied, and records the currently
+// applied objects in the inventory.
+func (r *Runner) pruneObjects(ctx context.Context, e *execution) error {
+	key := inventoryKey(e)
+	id := inventoryID(key)
+
+	applied, err := r.appliedRefs(e)
+	if err != nil {
+		return err
+	}
+
+	stale, err := r.staleObjects(ctx, id, applied)
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for _, ref := range stale {
+		// Objects that are not pruned are kept in the inventory, so that
+		// they are pruned once that is possible.
+		if !r.prune.allowed(ref.groupKind()) {
+			level.Info(r.logger).Log("msg", "kind not allowed to be pruned, skipping", "object", ref)
+			applied[ref.String()] = ref
+			continue
+		}
+		if r.prune.DryRun {
+			level.Info(r.logger).Log("msg", "would prune object", "object", ref)
+			applied[ref.String()] = ref
+			continue
+		}
+
+		level.Info(r.logger).Log("msg", "pruning object", "object", ref)
+		if err := r.deleteRef(ctx, ref); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("prune %s: %w", ref, err))
+			applied[ref.String()] = ref
+		}
+	}
+
+	if err := r.writeInventory(ctx, key, id, applied); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("write inventory: %w", err))
+	}
+
+	return errs
+}
+
+func (r *Runner) deleteRef(ctx context.Context, ref inventoryRef) error {
+	cl, err := r.cluster(ref.Cluster)
+	if err != nil {
+		return err
+	}
+	rc, err := cl.client.ClientForUnstructured(ref.object())
+	if err != nil {
+		return err
+	}
+
+	return deleteIfExists(ctx, rc, ref.Name)
+}
+
+// printStaleObjects writes the objects that would be pruned to out.
+func (r *Runner) printStaleObjects(ctx context.Context, e *execution, out io.Writer) error {
+	id := inventoryID(inventoryKey(e))
+
+	applied, err := r.appliedRefs(e)
+	if err != nil {
+		return err
+	}
+
+	stale, err := r.staleObjects(ctx, id, applied)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "# Prune\n")
+	for _, ref := range stale {
+		if !r.prune.allowed(ref.groupKind()) {
+			fmt.Fprintf(out, "not pruning %s: kind not allowed\n", ref)
+			continue
+		}
+		fmt.Fprintf(out, "would prune %s\n", ref)
+	}
+
+	return nil
+}
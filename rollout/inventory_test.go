@@ -0,0 +1,172 @@
+package rollout
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// discoveryClient returns a client that knows ConfigMaps, Services,
+// Deployments, Jobs and Namespaces, backed by a fake dynamic client with the given
+// objects.
+func discoveryClient(objects ...runtime.Object) *client.Client {
+	kc := kubefake.NewSimpleClientset()
+	kc.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "configmaps", Kind: "ConfigMap", Namespaced: true},
+			{Name: "services", Kind: "Service", Namespaced: true},
+			{Name: "namespaces", Kind: "Namespace", Namespaced: false},
+		},
+	}, {
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true}},
+	}, {
+		GroupVersion: "batch/v1",
+		APIResources: []metav1.APIResource{{Name: "jobs", Kind: "Job", Namespaced: true}},
+	}}
+	c := client.NewClient(nil, kc)
+	c.SetDynamicClient(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objects...))
+	return c
+}
+
+func deployment(name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("apps/v1")
+	u.SetKind("Deployment")
+	u.SetNamespace("default")
+	u.SetName(name)
+	return u
+}
+
+func TestAppliedRefsBlueGreen(t *testing.T) {
+	e := &execution{res: &render.Result{
+		Objects: map[string]*unstructured.Unstructured{"app": deployment("app")},
+		Rollout: &types.Rollout{Spec: &types.RolloutSpec{Groups: []*types.RolloutGroup{{
+			Name:  "main",
+			Steps: []*types.Step{{Object: "app", Action: (&BlueGreenObjectAction{}).Name()}},
+		}}}},
+	}}
+
+	r := &Runner{client: discoveryClient()}
+	refs, err := r.appliedRefs(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for k := range refs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	expected := []string{"apps/v1/Deployment/default/app-blue", "apps/v1/Deployment/default/app-green"}
+	if len(keys) != len(expected) || keys[0] != expected[0] || keys[1] != expected[1] {
+		t.Fatalf("expected refs %v, got %v", expected, keys)
+	}
+}
+
+func TestAppliedRefsDefaultNamespaceAndWhen(t *testing.T) {
+	defaulted := configMap("defaulted", "value")
+	defaulted.SetNamespace("")
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName("apps")
+
+	spec := &types.RolloutSpec{Groups: []*types.RolloutGroup{{
+		Name: "main",
+		Steps: []*types.Step{
+			{Object: "defaulted", Action: "CreateOrUpdate"},
+			{Object: "ns", Action: "CreateOrUpdate"},
+			{Object: "skipped", Action: "CreateOrUpdate", When: "false"},
+		},
+	}}}
+	p, err := newPlan(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &execution{
+		plan: p,
+		res: &render.Result{
+			Objects: map[string]*unstructured.Unstructured{
+				"defaulted": defaulted,
+				"ns":        ns,
+				"skipped":   configMap("skipped", "value"),
+			},
+			Rollout: &types.Rollout{Spec: spec},
+		},
+	}
+
+	cl := discoveryClient()
+	cl.SetDefaultNamespace("apps")
+	r := &Runner{client: cl}
+	refs, err := r.appliedRefs(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for k := range refs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	expected := []string{"v1/ConfigMap/apps/defaulted", "v1/Namespace//apps"}
+	if len(keys) != len(expected) || keys[0] != expected[0] || keys[1] != expected[1] {
+		t.Fatalf("expected refs %v, got %v", expected, keys)
+	}
+}
+
+func TestPruneObjectsKindNoLongerServed(t *testing.T) {
+	ctx := context.Background()
+	key := "test"
+	id := inventoryID(key)
+	stale := configMap("stale", "value")
+	stale.SetLabels(map[string]string{InventoryLabel: id})
+	widget := inventoryRef{APIVersion: "example.com/v1", Kind: "Widget", Namespace: "default", Name: "widget"}
+
+	cl := discoveryClient(stale)
+	r := NewRunner(nil, log.NewNopLogger(), cl, nil, nil, DryRunNone)
+	r.SetPruneConfig(PruneConfig{Enabled: true, Namespace: "default"})
+	previous := map[string]inventoryRef{widget.String(): widget}
+	staleRef := newInventoryRef("", "default", stale)
+	previous[staleRef.String()] = staleRef
+	if err := r.writeInventory(ctx, key, id, previous); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &execution{config: &Config{Key: key}, res: scriptedResult(nil)}
+	if err := r.pruneObjects(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := cl.ClientForUnstructured(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Get(ctx, "stale", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the stale object to be pruned, got %v", err)
+	}
+	// The object of the kind no longer served is kept, so that it is pruned
+	// once the kind is served again.
+	refs, err := r.readInventory(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(refs, []inventoryRef{widget}) {
+		t.Fatalf("expected inventory %v, got %v", []inventoryRef{widget}, refs)
+	}
+}
@@ -0,0 +1,138 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/client"
+)
+
+// ObjectMutation changes rendered objects before they are rolled out. Only
+// objects owned by the rollout are mutated, not objects that are only
+// patched or deleted.
+type ObjectMutation interface {
+	Mutate(ctx context.Context, config *Config, u *unstructured.Unstructured) error
+}
+
+type ObjectMutationFunc func(ctx context.Context, config *Config, u *unstructured.Unstructured) error
+
+func (f ObjectMutationFunc) Mutate(ctx context.Context, config *Config, u *unstructured.Unstructured) error {
+	return f(ctx, config, u)
+}
+
+// mutateObjects applies all mutations to all objects owned by the rollout.
+func (r *Runner) mutateObjects(ctx context.Context, e *execution) error {
+	for _, object := range ownedObjects(e) {
+		err := eachObject(object, func(u *unstructured.Unstructured) error {
+			for _, m := range r.mutations {
+				if err := m.Mutate(ctx, e.config, u); err != nil {
+					return fmt.Errorf("mutate %s: %w", objectKey(u), err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CommonMetadataMutation adds labels and annotations to all objects. Labels
+// and annotations set on the rendered object take precedence.
+type CommonMetadataMutation struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+func (m *CommonMetadataMutation) Mutate(ctx context.Context, config *Config, u *unstructured.Unstructured) error {
+	if len(m.Labels) > 0 {
+		u.SetLabels(mergeCommon(u.GetLabels(), m.Labels))
+	}
+	if len(m.Annotations) > 0 {
+		u.SetAnnotations(mergeCommon(u.GetAnnotations(), m.Annotations))
+	}
+
+	return nil
+}
+
+func mergeCommon(current, common map[string]string) map[string]string {
+	if current == nil {
+		current = map[string]string{}
+	}
+	for k, v := range common {
+		if _, ok := current[k]; !ok {
+			current[k] = v
+		}
+	}
+	return current
+}
+
+// OwnerReferenceMutation sets the resource that triggered the execution as
+// the controller of all objects, so that they are garbage collected when it
+// is deleted. Objects the resource can't own are left untouched: a
+// namespaced resource can only own objects in its own namespace, and no
+// cluster-scoped objects or objects of kinds the API server doesn't serve
+// yet, whose scope is unknown.
+type OwnerReferenceMutation struct {
+	Logger log.Logger
+	Client *client.Client
+}
+
+func (m *OwnerReferenceMutation) Mutate(ctx context.Context, config *Config, u *unstructured.Unstructured) error {
+	if config == nil || config.Object == nil {
+		return nil
+	}
+	owner := config.Object
+
+	if owner.GetNamespace() != "" {
+		// Cluster-scoped objects have no namespace, so they never match.
+		namespace, err := m.Client.ObjectNamespace(u)
+		var unknown *client.UnknownKindError
+		if errors.As(err, &unknown) {
+			// The kind may be defined by a CustomResourceDefinition
+			// that is rolled out by an earlier step.
+			level.Debug(m.Logger).Log("msg", "not setting owner reference on object of unknown kind", "object", objectKey(u), "owner", objectKey(owner))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if namespace != owner.GetNamespace() {
+			level.Debug(m.Logger).Log("msg", "not setting owner reference across namespaces", "object", objectKey(u), "owner", objectKey(owner))
+			return nil
+		}
+	}
+
+	refs := []metav1.OwnerReference{}
+	for _, ref := range u.GetOwnerReferences() {
+		if ref.UID == owner.GetUID() {
+			continue
+		}
+		if ref.Controller != nil && *ref.Controller {
+			level.Warn(m.Logger).Log("msg", "object already has a controller, not setting owner reference", "object", objectKey(u), "controller", ref.Kind+"/"+ref.Name)
+			return nil
+		}
+		refs = append(refs, ref)
+	}
+
+	isController := true
+	blockOwnerDeletion := true
+	u.SetOwnerReferences(append(refs, metav1.OwnerReference{
+		APIVersion:         owner.GetAPIVersion(),
+		Kind:               owner.GetKind(),
+		Name:               owner.GetName(),
+		UID:                owner.GetUID(),
+		Controller:         &isController,
+		BlockOwnerDeletion: &blockOwnerDeletion,
+	}))
+
+	return nil
+}
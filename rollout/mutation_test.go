@@ -0,0 +1,104 @@
+package rollout
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/brancz/locutus/client"
+)
+
+func TestCommonMetadataMutation(t *testing.T) {
+	u := configMap("cm", "value")
+	u.SetLabels(map[string]string{"team": "rendered"})
+
+	m := &CommonMetadataMutation{
+		Labels:      map[string]string{"team": "common", "env": "prod"},
+		Annotations: map[string]string{"owner": "locutus"},
+	}
+	if err := m.Mutate(context.Background(), nil, u); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := u.GetLabels()
+	if labels["team"] != "rendered" || labels["env"] != "prod" {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	if u.GetAnnotations()["owner"] != "locutus" {
+		t.Fatalf("unexpected annotations %v", u.GetAnnotations())
+	}
+}
+
+func TestOwnerReferenceMutation(t *testing.T) {
+	kc := kubefake.NewSimpleClientset()
+	kc.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "configmaps", Kind: "ConfigMap", Namespaced: true},
+			{Name: "namespaces", Kind: "Namespace", Namespaced: false},
+		},
+	}}
+	m := &OwnerReferenceMutation{Logger: log.NewNopLogger(), Client: client.NewClient(nil, kc)}
+
+	owner := configMap("owner", "value")
+	owner.SetUID("1234")
+	config := &Config{Object: owner}
+
+	u := configMap("cm", "value")
+	if err := m.Mutate(context.Background(), config, u); err != nil {
+		t.Fatal(err)
+	}
+	refs := u.GetOwnerReferences()
+	if len(refs) != 1 || refs[0].UID != "1234" || refs[0].Controller == nil || !*refs[0].Controller {
+		t.Fatalf("unexpected owner references %v", refs)
+	}
+
+	// A second mutation must not add a duplicate reference.
+	if err := m.Mutate(context.Background(), config, u); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.GetOwnerReferences()) != 1 {
+		t.Fatalf("unexpected owner references %v", u.GetOwnerReferences())
+	}
+
+	// An object without namespace is placed in the default namespace, the
+	// owner's.
+	defaulted := configMap("defaulted", "value")
+	defaulted.SetNamespace("")
+	if err := m.Mutate(context.Background(), config, defaulted); err != nil {
+		t.Fatal(err)
+	}
+	if len(defaulted.GetOwnerReferences()) != 1 {
+		t.Fatalf("expected an owner reference on an object in the default namespace, got %v", defaulted.GetOwnerReferences())
+	}
+
+	other := configMap("other", "value")
+	other.SetNamespace("other")
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName("test")
+	elsewhere := configMap("elsewhere", "value")
+	elsewhere.SetNamespace("")
+	// The CustomResourceDefinition of the kind may be rolled out by an
+	// earlier step, after objects are mutated.
+	widget := &unstructured.Unstructured{}
+	widget.SetAPIVersion("example.com/v1")
+	widget.SetKind("Widget")
+	widget.SetName("test")
+	widget.SetNamespace(owner.GetNamespace())
+	m.Client.SetDefaultNamespace("elsewhere")
+	for _, u := range []*unstructured.Unstructured{other, ns, elsewhere, widget} {
+		if err := m.Mutate(context.Background(), config, u); err != nil {
+			t.Fatal(err)
+		}
+		if len(u.GetOwnerReferences()) != 0 {
+			t.Fatalf("expected no owner references on %s, got %v", objectKey(u), u.GetOwnerReferences())
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	apitypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/brancz/locutus/client"
+)
+
+const (
+	// jsonPatchField is the field of a JSONPatch object holding the list of
+	// patch operations.
+	jsonPatchField = "patch"
+)
+
+var (
+	ErrPatchTargetNotFound = errors.New("patch target does not exist")
+)
+
+// PatchObjectAction patches an existing object, that is identified by the
+// apiVersion, kind, namespace and name of the rendered object. For merge
+// patches and strategic merge patches the rendered object is the patch
+// document. For JSON patches the rendered object holds the list of
+// operations in its "patch" field.
+//
+// Patched objects are not owned by the rollout, so they are neither labelled
+// with the inventory nor pruned.
+type PatchObjectAction struct {
+	PatchType apitypes.PatchType
+}
+
+func (a *PatchObjectAction) Execute(ctx context.Context, rc *client.ResourceClient, u *unstructured.Unstructured) error {
+	patch, err := a.patchFor(u)
+	if err != nil {
+		return err
+	}
+
+	_, err = rc.Patch(ctx, u.GetName(), a.PatchType, patch, metav1.PatchOptions{})
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrPatchTargetNotFound, objectKey(u))
+	}
+
+	return err
+}
+
+func (a *PatchObjectAction) patchFor(u *unstructured.Unstructured) ([]byte, error) {
+	if a.PatchType != apitypes.JSONPatchType {
+		return json.Marshal(u.Object)
+	}
+
+	ops, found, err := unstructured.NestedSlice(u.Object, jsonPatchField)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON patch for %s: %w", objectKey(u), err)
+	}
+	if !found {
+		return nil, fmt.Errorf("invalid JSON patch for %s: missing %q field", objectKey(u), jsonPatchField)
+	}
+
+	return json.Marshal(ops)
+}
+
+func (a *PatchObjectAction) Name() string {
+	switch a.PatchType {
+	case apitypes.JSONPatchType:
+		return "JSONPatch"
+	case apitypes.MergePatchType:
+		return "MergePatch"
+	case apitypes.StrategicMergePatchType:
+		return "StrategicMergePatch"
+	}
+	return string(a.PatchType)
+}
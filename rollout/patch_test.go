@@ -0,0 +1,78 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/brancz/locutus/client"
+)
+
+func TestPatchObjectAction(t *testing.T) {
+	ctx := context.Background()
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), configMap("existing", "old"))
+	rc := &client.ResourceClient{ResourceInterface: dc.Resource(gvr).Namespace("default")}
+
+	mergePatch := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":      "existing",
+				"namespace": "default",
+				"annotations": map[string]interface{}{
+					"example.com/owner": "team",
+				},
+			},
+		},
+	}
+	if err := (&PatchObjectAction{PatchType: apitypes.MergePatchType}).Execute(ctx, rc, mergePatch); err != nil {
+		t.Fatal(err)
+	}
+
+	jsonPatch := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":      "existing",
+				"namespace": "default",
+			},
+			"patch": []interface{}{
+				map[string]interface{}{
+					"op":    "replace",
+					"path":  "/data/key",
+					"value": "new",
+				},
+			},
+		},
+	}
+	if err := (&PatchObjectAction{PatchType: apitypes.JSONPatchType}).Execute(ctx, rc, jsonPatch); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := rc.Get(ctx, "existing", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := u.GetAnnotations()["example.com/owner"]; owner != "team" {
+		t.Fatalf("expected annotation to be patched, got %q", owner)
+	}
+	if value, _, _ := unstructured.NestedString(u.Object, "data", "key"); value != "new" {
+		t.Fatalf("expected data to be patched, got %q", value)
+	}
+
+	missing := configMap("missing", "new")
+	err = (&PatchObjectAction{PatchType: apitypes.MergePatchType}).Execute(ctx, rc, missing)
+	if !errors.Is(err, ErrPatchTargetNotFound) {
+		t.Fatalf("expected patch target not found error, got: %v", err)
+	}
+}
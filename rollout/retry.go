@@ -0,0 +1,127 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/brancz/locutus/rollout/types"
+)
+
+const (
+	defaultInitialBackoff = time.Second
+)
+
+// checksFailedError marks errors returned by a step's success checks, as
+// opposed to errors returned by its action.
+type checksFailedError struct {
+	err error
+}
+
+func (e *checksFailedError) Error() string {
+	return fmt.Sprintf("success checks failed: %v", e.err)
+}
+
+func (e *checksFailedError) Unwrap() error {
+	return e.err
+}
+
+// classifyError returns the class of an error a step failed with, and false
+// if the error doesn't belong to any class.
+func classifyError(err error) (types.ErrorClass, bool) {
+	switch {
+	case apierrors.IsConflict(err):
+		return types.ErrorClassConflict, true
+	case apierrors.IsTooManyRequests(err):
+		return types.ErrorClassTooManyRequests, true
+	case apierrors.IsServerTimeout(err), apierrors.IsTimeout(err):
+		return types.ErrorClassTimeout, true
+	case apierrors.IsInternalError(err), apierrors.IsServiceUnavailable(err), apierrors.IsUnexpectedServerError(err):
+		return types.ErrorClassServerError, true
+	}
+
+	var cerr *checksFailedError
+	if errors.As(err, &cerr) {
+		return types.ErrorClassCheckFailed, true
+	}
+
+	return "", false
+}
+
+// retryable returns whether the error is retried by the policy, and the class
+// of the error.
+func retryable(policy *types.RetryPolicy, err error) (types.ErrorClass, bool) {
+	class, ok := classifyError(err)
+	if !ok {
+		return "", false
+	}
+
+	retryOn := policy.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = types.DefaultRetryOn
+	}
+	for _, c := range retryOn {
+		if c == class {
+			return class, true
+		}
+	}
+
+	return class, false
+}
+
+// nextBackoff doubles the backoff, capped at the policy's maximum backoff.
+func nextBackoff(policy *types.RetryPolicy, backoff time.Duration) time.Duration {
+	backoff *= 2
+	if policy.MaxBackoff.Duration > 0 && backoff > policy.MaxBackoff.Duration {
+		return policy.MaxBackoff.Duration
+	}
+	return backoff
+}
+
+// runStepWithRetries runs the step, retrying it according to its retry
+// policy.
+func (r *Runner) runStepWithRetries(ctx context.Context, e *execution, group *types.RolloutGroup, step *types.Step) error {
+	policy := step.Retry
+	if policy == nil {
+		policy = &types.RetryPolicy{Attempts: 1}
+	}
+
+	backoff := policy.InitialBackoff.Duration
+	if backoff <= 0 {
+		backoff = defaultInitialBackoff
+	}
+	if policy.MaxBackoff.Duration > 0 && backoff > policy.MaxBackoff.Duration {
+		backoff = policy.MaxBackoff.Duration
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := r.runStep(ctx, e, group, step)
+		if err == nil {
+			r.metrics.stepAttempts.WithLabelValues("succeeded").Inc()
+			return nil
+		}
+
+		class, retry := retryable(policy, err)
+		if !retry || attempt >= policy.Attempts || ctx.Err() != nil {
+			r.metrics.stepAttempts.WithLabelValues("failed").Inc()
+			if attempt > 1 {
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+
+		r.metrics.stepAttempts.WithLabelValues("retried").Inc()
+		level.Warn(r.logger).Log("msg", "step attempt failed, retrying", "group", group.Name, "step", step.Name, "attempt", attempt, "attempts", policy.Attempts, "class", class, "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(policy, backoff)
+	}
+}
@@ -0,0 +1,176 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/brancz/locutus/rollout/types"
+)
+
+func TestRetryable(t *testing.T) {
+	gr := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	cases := []struct {
+		name    string
+		retryOn []types.ErrorClass
+		err     error
+		class   types.ErrorClass
+		retry   bool
+	}{
+		{
+			name:  "conflict",
+			err:   fmt.Errorf("failed to execute action: %w", apierrors.NewConflict(gr, "test", errors.New("conflict"))),
+			class: types.ErrorClassConflict,
+			retry: true,
+		},
+		{
+			name:  "server error",
+			err:   apierrors.NewInternalError(errors.New("webhook failed")),
+			class: types.ErrorClassServerError,
+			retry: true,
+		},
+		{
+			name:  "not found",
+			err:   apierrors.NewNotFound(gr, "test"),
+			retry: false,
+		},
+		{
+			name:  "checks failed by default",
+			err:   &checksFailedError{err: errors.New("timed out")},
+			class: types.ErrorClassCheckFailed,
+			retry: false,
+		},
+		{
+			name:    "checks failed if configured",
+			retryOn: []types.ErrorClass{types.ErrorClassCheckFailed},
+			err:     &checksFailedError{err: errors.New("timed out")},
+			class:   types.ErrorClassCheckFailed,
+			retry:   true,
+		},
+		{
+			name:    "conflict if not configured",
+			retryOn: []types.ErrorClass{types.ErrorClassTimeout},
+			err:     apierrors.NewConflict(gr, "test", errors.New("conflict")),
+			class:   types.ErrorClassConflict,
+			retry:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			class, retry := retryable(&types.RetryPolicy{RetryOn: c.retryOn}, c.err)
+			if class != c.class {
+				t.Errorf("expected class %q, got %q", c.class, class)
+			}
+			if retry != c.retry {
+				t.Errorf("expected retry to be %v, got %v", c.retry, retry)
+			}
+		})
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	policy := &types.RetryPolicy{MaxBackoff: types.Duration{Duration: 5 * time.Second}}
+
+	backoff := 2 * time.Second
+	backoff = nextBackoff(policy, backoff)
+	if backoff != 4*time.Second {
+		t.Fatalf("expected backoff to double to 4s, got %s", backoff)
+	}
+	backoff = nextBackoff(policy, backoff)
+	if backoff != 5*time.Second {
+		t.Fatalf("expected backoff to be capped at 5s, got %s", backoff)
+	}
+}
+
+func TestRunStepWithRetries(t *testing.T) {
+	gr := schema.GroupResource{Resource: "configmaps"}
+	conflict := apierrors.NewConflict(gr, "app", errors.New("conflict"))
+	repeat := func(err error, n int) []error {
+		errs := []error{}
+		for i := 0; i < n; i++ {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		retryOn  []types.ErrorClass
+		failed   bool
+		attempts int
+		retried  float64
+	}{
+		{name: "succeeds after retries", errs: repeat(conflict, 2), attempts: 3, retried: 2},
+		{name: "gives up after attempts", errs: repeat(conflict, 5), failed: true, attempts: 3, retried: 2},
+		{name: "unclassified error", errs: []error{errors.New("invalid")}, failed: true, attempts: 1},
+		{name: "class not retried", errs: repeat(conflict, 1), retryOn: []types.ErrorClass{types.ErrorClassCheckFailed}, failed: true, attempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			action := &scriptedAction{errs: map[string][]error{"app": tc.errs}}
+			r := scriptedRunner(action)
+			group := &types.RolloutGroup{Name: "main", Steps: []*types.Step{{
+				Object: "app",
+				Action: "Scripted",
+				Retry: &types.RetryPolicy{
+					Attempts:       3,
+					InitialBackoff: types.Duration{Duration: time.Millisecond},
+					RetryOn:        tc.retryOn,
+				},
+			}}}
+			e := &execution{res: scriptedResult([]string{"app"}, group)}
+
+			err := r.runStepWithRetries(context.Background(), e, group, group.Steps[0])
+			if tc.failed != (err != nil) {
+				t.Fatalf("expected failure %t, got %v", tc.failed, err)
+			}
+			if tc.failed && tc.attempts > 1 && !strings.Contains(err.Error(), fmt.Sprintf("giving up after %d attempts", tc.attempts)) {
+				t.Fatalf("expected to give up after %d attempts, got %v", tc.attempts, err)
+			}
+			if n := len(action.executions()); n != tc.attempts {
+				t.Fatalf("expected %d attempts, got %d", tc.attempts, n)
+			}
+
+			result := "succeeded"
+			if tc.failed {
+				result = "failed"
+			}
+			if v := testutil.ToFloat64(r.metrics.stepAttempts.WithLabelValues(result)); v != 1 {
+				t.Fatalf("expected one %s attempt, got %v", result, v)
+			}
+			if v := testutil.ToFloat64(r.metrics.stepAttempts.WithLabelValues("retried")); v != tc.retried {
+				t.Fatalf("expected %v retried attempts, got %v", tc.retried, v)
+			}
+		})
+	}
+}
+
+func TestRunStepWithRetriesCancelled(t *testing.T) {
+	gr := schema.GroupResource{Resource: "configmaps"}
+	action := &scriptedAction{errs: map[string][]error{"app": {apierrors.NewConflict(gr, "app", errors.New("conflict"))}}}
+	r := scriptedRunner(action)
+	group := &types.RolloutGroup{Name: "main", Steps: []*types.Step{{
+		Object: "app",
+		Action: "Scripted",
+		Retry:  &types.RetryPolicy{Attempts: 3, InitialBackoff: types.Duration{Duration: time.Minute}},
+	}}}
+	e := &execution{res: scriptedResult([]string{"app"}, group)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	// The backoff is cut short, the step isn't attempted again.
+	if err := r.runStepWithRetries(ctx, e, group, group.Steps[0]); !apierrors.IsConflict(err) {
+		t.Fatalf("expected the conflict of the first attempt, got %v", err)
+	}
+	if n := len(action.executions()); n != 1 {
+		t.Fatalf("expected one attempt, got %d", n)
+	}
+}
@@ -0,0 +1,141 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/hashicorp/go-multierror"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/client"
+)
+
+// objectKey identifies an object across API groups and namespaces.
+func objectKey(u *unstructured.Unstructured) string {
+	return fmt.Sprintf("%s/%s/%s/%s", u.GetAPIVersion(), u.GetKind(), u.GetNamespace(), u.GetName())
+}
+
+type rollbackEntry struct {
+	rc     *client.ResourceClient
+	object *unstructured.Unstructured
+	// previous is the live object before it was first touched by the
+	// execution, nil if the object did not exist.
+	previous *unstructured.Unstructured
+}
+
+// rollbackJournal records the state of objects before they are mutated by an
+// execution, so that they can be restored should the execution fail.
+type rollbackJournal struct {
+	mtx     sync.Mutex
+	seen    map[string]struct{}
+	entries []*rollbackEntry
+}
+
+func newRollbackJournal() *rollbackJournal {
+	return &rollbackJournal{
+		seen: map[string]struct{}{},
+	}
+}
+
+func (j *rollbackJournal) recorded(key string) bool {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	_, ok := j.seen[key]
+	return ok
+}
+
+// snapshot records the live state of the object in the named cluster,
+// unless it was already recorded earlier in the execution, in which case the
+// earlier state is the one to restore.
+func (j *rollbackJournal) snapshot(ctx context.Context, cluster string, rc *client.ResourceClient, u *unstructured.Unstructured) error {
+	key := objectKey(u)
+	if cluster != "" {
+		key = cluster + ":" + key
+	}
+	if j.recorded(key) {
+		return nil
+	}
+
+	var previous *unstructured.Unstructured
+	current, err := rc.Get(ctx, u.GetName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("snapshot %s: %w", key, err)
+	}
+	if err == nil {
+		previous = current.DeepCopy()
+	}
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if _, ok := j.seen[key]; ok {
+		return nil
+	}
+	j.seen[key] = struct{}{}
+	j.entries = append(j.entries, &rollbackEntry{
+		rc:       rc,
+		object:   u.DeepCopy(),
+		previous: previous,
+	})
+
+	return nil
+}
+
+// rollback restores all recorded objects in reverse order. Restoring
+// continues on errors, so that as much as possible is rolled back.
+func (j *rollbackJournal) rollback(ctx context.Context, logger log.Logger) error {
+	j.mtx.Lock()
+	entries := make([]*rollbackEntry, len(j.entries))
+	copy(entries, j.entries)
+	j.mtx.Unlock()
+
+	var errs error
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		level.Debug(logger).Log("msg", "rolling back object", "object", objectKey(e.object), "existed", e.previous != nil)
+		if err := e.restore(ctx); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("roll back %s: %w", objectKey(e.object), err))
+		}
+	}
+
+	return errs
+}
+
+func (e *rollbackEntry) restore(ctx context.Context) error {
+	name := e.object.GetName()
+
+	if e.previous == nil {
+		propagationPolicy := metav1.DeletePropagationForeground
+		err := e.rc.Delete(ctx, name, metav1.DeleteOptions{
+			PropagationPolicy: &propagationPolicy,
+		})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	previous := e.previous.DeepCopy()
+	previous.SetManagedFields(nil)
+
+	current, err := e.rc.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		previous.SetResourceVersion("")
+		previous.SetUID("")
+		previous.SetCreationTimestamp(metav1.Time{})
+		previous.SetDeletionTimestamp(nil)
+		_, err := e.rc.Create(ctx, previous, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// The previous object is restored as it was, not merged.
+	_, err = e.rc.WithUpdateStrategy(client.UpdateStrategyReplace).UpdateWithCurrent(ctx, current, previous)
+	return err
+}
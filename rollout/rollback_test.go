@@ -0,0 +1,81 @@
+package rollout
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/brancz/locutus/client"
+)
+
+func configMap(name, value string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "default",
+			},
+			"data": map[string]interface{}{
+				"key": value,
+			},
+		},
+	}
+}
+
+func TestRollbackJournal(t *testing.T) {
+	ctx := context.Background()
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), configMap("existing", "old"))
+	rc := &client.ResourceClient{ResourceInterface: dc.Resource(gvr).Namespace("default")}
+
+	j := newRollbackJournal()
+
+	existing := configMap("existing", "new")
+	if err := j.snapshot(ctx, "", rc, existing); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	created := configMap("created", "new")
+	if err := j.snapshot(ctx, "", rc, created); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Create(ctx, created, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second snapshot of the same object must not overwrite the original
+	// state.
+	if err := j.snapshot(ctx, "", rc, existing); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.rollback(ctx, log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := rc.Get(ctx, "existing", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _, _ := unstructured.NestedString(restored.Object, "data", "key")
+	if value != "old" {
+		t.Fatalf("expected restored value %q, got %q", "old", value)
+	}
+
+	_, err = rc.Get(ctx, "created", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("expected newly created object to be deleted, got: %v", err)
+	}
+}
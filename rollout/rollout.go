@@ -10,6 +10,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/google/cel-go/cel"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,6 +18,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/db"
 	"github.com/brancz/locutus/feedback"
 	"github.com/brancz/locutus/render"
 	"github.com/brancz/locutus/rollout/checks"
@@ -31,19 +33,46 @@ type rolloutMetrics struct {
 	executionDuration prometheus.Summary
 	executions        prometheus.Counter
 	executionsFailed  prometheus.Counter
+	rollbacks         prometheus.Counter
+	rollbacksFailed   prometheus.Counter
+	steps             *prometheus.CounterVec
+	stepAttempts      *prometheus.CounterVec
+	groups            *prometheus.CounterVec
+	hooks             *prometheus.CounterVec
+	drift             *prometheus.GaugeVec
 }
 
 type Runner struct {
-	logger     log.Logger
-	client     *client.Client
-	actions    map[string]ObjectAction
-	checks     *checks.Checks
-	provider   Renderer
-	renderOnly bool
-	metrics    *rolloutMetrics
+	logger   log.Logger
+	client   *client.Client
+	actions  map[string]ObjectAction
+	checks   *checks.Checks
+	provider Renderer
+	dryRun   DryRunStrategy
+	prune    PruneConfig
+	history  HistoryConfig
+	// driftDetect only compares rendered objects with their live state,
+	// instead of rolling them out.
+	driftDetect bool
+	// driftSeries holds the series of the drift metric set by the last
+	// drift detection of each trigger key, so that series of objects no
+	// longer rendered are removed without touching other keys.
+	driftMtx    sync.Mutex
+	driftSeries map[string]map[driftSeries]bool
+	// contentHash stamps the content hash of rendered objects into them.
+	contentHash bool
+	// mutations are applied to rendered objects before they are rolled out.
+	mutations []ObjectMutation
+	// clusters are the clients of the clusters groups and steps may roll
+	// out to, by name.
+	clusters map[string]*client.Client
+	// approvals is nil if gates can't be approved through HTTP.
+	approvals           *Approvals
+	databaseConnections *db.Connections
+	metrics             *rolloutMetrics
 }
 
-func NewRunner(r prometheus.Registerer, logger log.Logger, client *client.Client, renderer Renderer, checks *checks.Checks, renderOnly bool) *Runner {
+func NewRunner(r prometheus.Registerer, logger log.Logger, client *client.Client, renderer Renderer, checks *checks.Checks, dryRun DryRunStrategy) *Runner {
 	m := &rolloutMetrics{
 		executionDuration: prometheus.NewSummary(prometheus.SummaryOpts{
 			Name: "rollout_execution_duration_seconds",
@@ -57,22 +86,57 @@ func NewRunner(r prometheus.Registerer, logger log.Logger, client *client.Client
 			Name: "rollout_executions_failed_total",
 			Help: "Total number of times rollouts failed.",
 		}),
+		rollbacks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rollout_rollbacks_total",
+			Help: "Total number of times failed rollouts have been rolled back.",
+		}),
+		rollbacksFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rollout_rollbacks_failed_total",
+			Help: "Total number of times rolling back a failed rollout failed.",
+		}),
+		steps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rollout_steps_total",
+			Help: "Total number of steps run, by result.",
+		}, []string{"result"}),
+		stepAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rollout_step_attempts_total",
+			Help: "Total number of attempts to run steps, by result.",
+		}, []string{"result"}),
+		groups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rollout_groups_total",
+			Help: "Total number of groups run, by failure policy and result.",
+		}, []string{"failure_policy", "result"}),
+		hooks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rollout_hooks_total",
+			Help: "Total number of hooks run, by phase and result.",
+		}, []string{"phase", "result"}),
+		drift: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "locutus_object_drift",
+			Help: "Whether the live object differs from the rendered one, 1 if it drifted and 0 if not. Only set in drift detection mode.",
+		}, []string{"cluster", "gvk", "object"}),
 	}
 
 	if r != nil {
 		r.MustRegister(m.executionDuration)
 		r.MustRegister(m.executions)
 		r.MustRegister(m.executionsFailed)
+		r.MustRegister(m.rollbacks)
+		r.MustRegister(m.rollbacksFailed)
+		r.MustRegister(m.steps)
+		r.MustRegister(m.stepAttempts)
+		r.MustRegister(m.groups)
+		r.MustRegister(m.hooks)
+		r.MustRegister(m.drift)
 	}
 
 	return &Runner{
-		logger:     logger,
-		client:     client,
-		actions:    map[string]ObjectAction{},
-		checks:     checks,
-		provider:   renderer,
-		renderOnly: renderOnly,
-		metrics:    m,
+		logger:   logger,
+		client:   client,
+		actions:  map[string]ObjectAction{},
+		checks:   checks,
+		provider: renderer,
+		dryRun:   dryRun,
+		metrics:  m,
 	}
 }
 
@@ -82,9 +146,66 @@ func (r *Runner) SetObjectActions(actions []ObjectAction) {
 	}
 }
 
+func (r *Runner) SetPruneConfig(config PruneConfig) {
+	r.prune = config
+}
+
+func (r *Runner) SetHistoryConfig(config HistoryConfig) {
+	r.history = config
+}
+
+// SetApprovals configures where gates waiting for approval are registered,
+// so that they can be approved through HTTP.
+func (r *Runner) SetApprovals(approvals *Approvals) {
+	r.approvals = approvals
+}
+
+// SetDatabaseConnections configures the databases gates can be approved
+// through.
+func (r *Runner) SetDatabaseConnections(connections *db.Connections) {
+	r.databaseConnections = connections
+}
+
+// SetClusters configures the clusters groups and steps may roll out to
+// instead of the cluster of the runner's client, by name.
+func (r *Runner) SetClusters(clusters map[string]*client.Client) {
+	r.clusters = clusters
+}
+
+// SetDriftDetection configures only detecting drift between the rendered
+// and the live objects, instead of rolling them out. Nothing is changed in
+// the cluster, not even the history or feedback.
+func (r *Runner) SetDriftDetection(enabled bool) {
+	r.driftDetect = enabled
+}
+
+// SetContentHash configures stamping the hash of each rendered object into
+// its content hash annotation, so that updates of unchanged objects can be
+// skipped using client.CheckContentHashForUpdate. It has no effect with drift
+// detection.
+func (r *Runner) SetContentHash(enabled bool) {
+	r.contentHash = enabled
+}
+
+// SetObjectMutations configures the mutations applied to rendered objects
+// before they are rolled out, in order.
+func (r *Runner) SetObjectMutations(mutations []ObjectMutation) {
+	r.mutations = mutations
+}
+
 type Config struct {
+	// Key identifies what triggered the execution, for example the
+	// namespace/name key of the triggering resource. Executions triggered
+	// by the same thing share the same key.
+	Key       string
 	RawConfig []byte
 	Feedback  feedback.Feedback
+	// Object is the resource that triggered the execution, if any.
+	Object *unstructured.Unstructured
+	// Rendered is rolled out instead of rendering, for triggers that
+	// already know the objects and rollout, such as Rollouts watched in
+	// the cluster.
+	Rendered *render.Result
 }
 
 func (r *Runner) Execute(ctx context.Context, rolloutConfig *Config) (err error) {
@@ -103,15 +224,90 @@ func (r *Runner) Execute(ctx context.Context, rolloutConfig *Config) (err error)
 	}()
 
 	var res *render.Result
-	res, err = r.provider.Render(ctx, rawConfig)
-	if err != nil {
-		return fmt.Errorf("failed to render: %v", err)
+	var history *executionHistory
+	if r.history.Enabled && r.dryRun == DryRunNone && !r.driftDetect {
+		history = &executionHistory{start: begin}
+		defer func() {
+			// The execution may have been cancelled, which is worth
+			// recording all the more.
+			hctx, cancel := cleanupContext()
+			defer cancel()
+			if herr := r.recordHistory(hctx, rolloutConfig, res, history, err); herr != nil {
+				level.Warn(r.logger).Log("msg", "failed to record history", "err", herr)
+			}
+		}()
+	}
+
+	switch {
+	case rolloutConfig != nil && rolloutConfig.Rendered != nil:
+		res = rolloutConfig.Rendered
+	case r.provider == nil:
+		return errors.New("no renderer configured")
+	default:
+		res, err = r.provider.Render(ctx, rawConfig)
+		if err != nil {
+			return fmt.Errorf("failed to render: %v", err)
+		}
 	}
 
-	if r.renderOnly {
+	if r.dryRun == DryRunClient {
 		return json.NewEncoder(os.Stdout).Encode(res)
 	}
 
+	// All problems are reported at once, before anything is rolled out.
+	p, perr := newPlan(res.Rollout.Spec)
+	if verr := r.validate(res); perr != nil || verr != nil {
+		return fmt.Errorf("invalid rollout: %w", multierror.Append(perr, verr))
+	}
+
+	e := &execution{
+		res:     res,
+		plan:    p,
+		config:  rolloutConfig,
+		history: history,
+	}
+
+	if len(r.mutations) > 0 {
+		if err := r.mutateObjects(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	if len(p.groupWhen) > 0 || len(p.stepWhen) > 0 {
+		e.whenVars, err = whenVars(rolloutConfig, res)
+		if err != nil {
+			return fmt.Errorf("evaluate when expressions: %w", err)
+		}
+	}
+
+	if r.prune.Enabled {
+		if err := labelInventoryObjects(e, inventoryID(inventoryKey(e))); err != nil {
+			return fmt.Errorf("label objects: %w", err)
+		}
+	}
+
+	// Content hashes only serve skipping updates, which drift detection
+	// never makes.
+	if r.contentHash && !r.driftDetect {
+		if err := stampContentHashes(e); err != nil {
+			return fmt.Errorf("hash objects: %w", err)
+		}
+	}
+
+	if r.driftDetect {
+		return r.detectDrift(ctx, e)
+	}
+
+	if r.dryRun == DryRunServer {
+		if err := r.runDryRun(ctx, e, os.Stdout); err != nil {
+			return err
+		}
+		if r.prune.Enabled {
+			return r.printStaleObjects(ctx, e, os.Stdout)
+		}
+		return nil
+	}
+
 	if rolloutConfig != nil && rolloutConfig.Feedback != nil {
 
 		groups := []string{}
@@ -125,98 +321,312 @@ func (r *Runner) Execute(ctx context.Context, rolloutConfig *Config) (err error)
 		}
 	}
 
-	for _, group := range res.Rollout.Spec.Groups {
-		var wg sync.WaitGroup
-		var errsLock sync.Mutex
-		var errs error
-		for _, step := range group.Steps {
-			if group.Parallel {
-				wg.Add(1)
-
-				go func(step *types.Step) {
-					defer wg.Done()
-
-					if err := r.runStep(ctx, res, group.Name, step); err != nil {
-						errsLock.Lock()
-						errs = multierror.Append(errs, err)
-						errsLock.Unlock()
-						return
-					}
-				}(step)
-			} else {
-				if err := r.runStep(ctx, res, group.Name, step); err != nil {
-					if step.ContinueOnError {
-						level.Debug(r.logger).Log("msg", "step failed, but continuing", "step", step.Name, "err", err)
-					} else {
-						return fmt.Errorf("run step: %w", err)
-					}
-				}
-			}
+	if res.Rollout.Spec.RollbackOnFailure {
+		e.journal = newRollbackJournal()
+	}
+
+	if err := r.runGroups(ctx, e); err != nil {
+		if e.journal != nil {
+			return r.rollback(e.journal, err)
 		}
-		wg.Wait()
+		return err
+	}
+
+	if r.prune.Enabled {
+		if err := r.pruneObjects(ctx, e); err != nil {
+			return fmt.Errorf("prune: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// execution holds the state of a single rollout execution.
+type execution struct {
+	res    *render.Result
+	plan   *plan
+	config *Config
+	// journal is only set if the rollout is to be rolled back on failure.
+	journal *rollbackJournal
+	// history is only set if a history of executions is recorded.
+	history *executionHistory
+	// whenVars are the variables `when` expressions are evaluated against,
+	// only set if the rollout has any.
+	whenVars map[string]interface{}
+}
+
+// skipped returns whether the group or step with the compiled `when`
+// expression is to be skipped.
+func (e *execution) skipped(when cel.Program) (bool, error) {
+	ok, err := evalWhen(when, e.whenVars)
+	return !ok, err
+}
+
+// stepName returns the name of the step, falling back to the object it
+// refers to for unnamed steps.
+func stepName(step *types.Step) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return step.Object
+}
+
+// setCondition sets the feedback condition, if feedback is to be given.
+func (e *execution) setCondition(ctx context.Context, name string, status feedback.CurrentStatus) error {
+	if e.config == nil || e.config.Feedback == nil {
+		return nil
+	}
+	return e.config.Feedback.SetCondition(ctx, name, status)
+}
+
+// setConditionMessage sets the feedback condition with a message, if feedback
+// is to be given.
+func (e *execution) setConditionMessage(ctx context.Context, name string, status feedback.CurrentStatus, message string) error {
+	if e.config == nil || e.config.Feedback == nil {
+		return nil
+	}
+	return e.config.Feedback.SetConditionMessage(ctx, name, status, message)
+}
+
+func (r *Runner) runGroups(ctx context.Context, e *execution) error {
+	groups := e.res.Rollout.Spec.Groups
+	return e.plan.groups.run(ctx, false, func(ctx context.Context, i int) error {
+		return r.runGroup(ctx, e, groups[i], e.plan.steps[i])
+	})
+}
+
+func (r *Runner) runGroup(ctx context.Context, e *execution, group *types.RolloutGroup, steps *dag) error {
+	policy := group.FailurePolicy
+	if policy == "" {
+		policy = types.FailurePolicyWaitForAll
+	}
 
-		if errs != nil {
-			return errors.Wrap(errs, "failed to run step")
+	skip, err := e.skipped(e.plan.groupWhen[group])
+	if err == nil && skip {
+		level.Info(r.logger).Log("msg", "skipping group", "group", group.Name, "when", group.When)
+		r.metrics.groups.WithLabelValues(string(policy), "skipped").Inc()
+		return e.setCondition(ctx, group.Name, feedback.StatusConditionSkipped)
+	}
+	if err == nil {
+		err = e.setCondition(ctx, group.Name, feedback.StatusConditionInProgress)
+	}
+	if err == nil {
+		err = r.runHooks(ctx, e, group, "pre", group.PreHooks)
+	}
+	if err == nil {
+		err = r.runSteps(ctx, e, group, steps, policy)
+	}
+	if err == nil {
+		err = r.runHooks(ctx, e, group, "post", group.PostHooks)
+	}
+	if err != nil {
+		r.setFailedCondition(e, group.Name)
+		// The group is reported as failed either way, only the rollout
+		// continues.
+		if policy == types.FailurePolicyContinue {
+			r.metrics.groups.WithLabelValues(string(policy), "continued").Inc()
+			level.Warn(r.logger).Log("msg", "group failed, but continuing", "group", group.Name, "err", err)
+			return nil
 		}
+		r.metrics.groups.WithLabelValues(string(policy), "failed").Inc()
+		return errors.Wrapf(err, "failed to run group %q (failure policy %s)", group.Name, policy)
+	}
 
-		if rolloutConfig != nil && rolloutConfig.Feedback != nil {
-			err := rolloutConfig.Feedback.SetCondition(ctx, group.Name, feedback.StatusConditionFinished)
+	r.metrics.groups.WithLabelValues(string(policy), "succeeded").Inc()
+	return e.setCondition(ctx, group.Name, feedback.StatusConditionFinished)
+}
+
+func (r *Runner) runSteps(ctx context.Context, e *execution, group *types.RolloutGroup, steps *dag, policy types.FailurePolicy) error {
+	return steps.run(ctx, policy == types.FailurePolicyFailFast, func(ctx context.Context, i int) error {
+		step := group.Steps[i]
+		condition := group.Name + "/" + stepName(step)
+		begin := time.Now()
+		record := func(result string, err error) {
+			r.metrics.steps.WithLabelValues(result).Inc()
+
+			h := &StepHistory{
+				Group:    group.Name,
+				Step:     step.Name,
+				Object:   step.Object,
+				Action:   step.Action,
+				Result:   result,
+				Duration: types.Duration{Duration: time.Since(begin)},
+			}
 			if err != nil {
-				return err
+				h.Error = err.Error()
+			}
+			e.history.recordStep(h)
+		}
+
+		skip, err := e.skipped(e.plan.stepWhen[step])
+		if err == nil && skip {
+			level.Debug(r.logger).Log("msg", "skipping step", "group", group.Name, "step", step.Name, "when", step.When)
+			record("skipped", nil)
+			return e.setCondition(ctx, condition, feedback.StatusConditionSkipped)
+		}
+		if err == nil {
+			err = e.setCondition(ctx, condition, feedback.StatusConditionInProgress)
+		}
+		if err == nil {
+			err = r.runStepWithRetries(ctx, e, group, step)
+		}
+		if err != nil {
+			r.setFailedCondition(e, condition)
+			if ctx.Err() != nil {
+				record("cancelled", err)
+				return fmt.Errorf("step %q cancelled: %w", step.Name, err)
+			}
+
+			record("failed", err)
+			if step.ContinueOnError {
+				level.Debug(r.logger).Log("msg", "step failed, but continuing", "step", step.Name, "err", err)
+				return nil
 			}
+			return fmt.Errorf("run step %q: %w", step.Name, err)
 		}
+
+		record("succeeded", nil)
+		return e.setCondition(ctx, condition, feedback.StatusConditionFinished)
+	})
+}
+
+// setFailedCondition marks the condition as failed. The context of what
+// failed may be done, so the status is set with a cleanup context.
+func (r *Runner) setFailedCondition(e *execution, name string) {
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	if err := e.setCondition(ctx, name, feedback.StatusConditionFailed); err != nil {
+		level.Warn(r.logger).Log("msg", "failed to set feedback condition", "condition", name, "err", err)
 	}
+}
 
-	return nil
+// cleanupTimeout bounds cleaning up after a failed or cancelled execution.
+const cleanupTimeout = 5 * time.Minute
+
+// cleanupContext returns a context to clean up with, that isn't cancelled
+// along with the execution, as cleaning up is most needed when it was.
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
 }
 
-func (r *Runner) runStep(ctx context.Context, res *render.Result, groupName string, step *types.Step) error {
-	object, found := res.Objects[step.Object]
+// rollback restores the objects in the journal. The failure may have been
+// the execution being cancelled, so it is rolled back with a cleanup context.
+func (r *Runner) rollback(journal *rollbackJournal, cause error) error {
+	level.Info(r.logger).Log("msg", "rollout failed, rolling back", "err", cause)
+	r.metrics.rollbacks.Inc()
+
+	ctx, cancel := cleanupContext()
+	defer cancel()
+
+	if err := journal.rollback(ctx, r.logger); err != nil {
+		r.metrics.rollbacksFailed.Inc()
+		return multierror.Append(cause, fmt.Errorf("roll back: %w", err))
+	}
+
+	return fmt.Errorf("rolled back: %w", cause)
+}
+
+func (r *Runner) runStep(ctx context.Context, e *execution, group *types.RolloutGroup, step *types.Step) error {
+	if step.Gate != nil {
+		return r.runGate(ctx, e, group.Name, step)
+	}
+
+	object, found := e.res.Objects[step.Object]
 	if !found {
 		return fmt.Errorf("could not find object named %q", step.Object)
 	}
 
-	level.Debug(r.logger).Log("msg", "running action", "group", groupName, "action", step.Action, "object", step.Object)
+	cl, err := r.cluster(stepCluster(group, step))
+	if err != nil {
+		return err
+	}
+
+	level.Debug(r.logger).Log("msg", "running action", "group", group.Name, "action", step.Action, "object", step.Object, "cluster", cl.name)
 
-	err := r.executeAction(ctx, step.Action, object)
+	err = r.executeAction(ctx, e, cl, group.Name, step, object)
 	if err != nil {
-		return fmt.Errorf("failed to execute action (%s): %v", step.Action, err)
+		return fmt.Errorf("failed to execute action (%s): %w", step.Action, err)
 	}
 
-	return r.checks.RunChecks(
-		ctx,
-		step.Success,
-		object,
-	)
+	// Step actions run the success checks themselves, against the objects
+	// they actually roll out.
+	if action, err := r.objectAction(step.Action); err == nil {
+		if _, ok := action.(StepObjectAction); ok {
+			return nil
+		}
+	}
+
+	if err := cl.checks.RunChecks(ctx, step.Success, object); err != nil {
+		return &checksFailedError{err: err}
+	}
+
+	return nil
 }
 
-func (r *Runner) executeAction(ctx context.Context, actionName string, u *unstructured.Unstructured) error {
+func (r *Runner) executeAction(ctx context.Context, e *execution, cl *cluster, groupName string, step *types.Step, u *unstructured.Unstructured) error {
 	isList := u.IsList()
 	if isList {
 		return u.EachListItem(func(o runtime.Object) error {
 			u := o.(*unstructured.Unstructured)
 
-			return r.executeAction(ctx, actionName, u)
+			return r.executeAction(ctx, e, cl, groupName, step, u)
 		})
 	}
 
-	return r.executeSingleAction(ctx, actionName, u)
+	return r.executeSingleAction(ctx, e, cl, groupName, step, u)
 }
 
-func (r *Runner) executeSingleAction(ctx context.Context, actionName string, unstructured *unstructured.Unstructured) error {
+func (r *Runner) objectAction(actionName string) (ObjectAction, error) {
 	action, ok := r.actions[actionName]
 	if !ok {
 		actions := []string{}
 		for k := range r.actions {
 			actions = append(actions, k)
 		}
-		return fmt.Errorf("unknown action %q: available actions are %v", actionName, actions)
+		return nil, fmt.Errorf("unknown action %q: available actions are %v", actionName, actions)
+	}
+
+	return action, nil
+}
+
+func (r *Runner) executeSingleAction(ctx context.Context, e *execution, cl *cluster, groupName string, step *types.Step, unstructured *unstructured.Unstructured) error {
+	action, err := r.objectAction(step.Action)
+	if err != nil {
+		return err
 	}
 
-	rc, err := r.client.ClientForUnstructured(unstructured)
+	if cl.name != "" {
+		unstructured = foreignObject(e.config, unstructured)
+	}
+
+	rc, err := cl.client.ClientForUnstructured(unstructured)
 	if err != nil {
 		return err
 	}
+	rc = rc.WithIgnoreDifferences(ignoreDifferences(e.res.Rollout.Spec, step)...)
+
+	if e.journal != nil {
+		if err := e.journal.snapshot(ctx, cl.name, rc, unstructured); err != nil {
+			return err
+		}
+	}
+
+	if sa, ok := action.(StepObjectAction); ok {
+		var f feedback.Feedback
+		if e.config != nil {
+			f = e.config.Feedback
+		}
+		return sa.ExecuteStep(ctx, &StepContext{
+			Logger:   r.logger,
+			Group:    groupName,
+			Step:     step,
+			Client:   cl.client,
+			Checks:   cl.checks,
+			Feedback: f,
+			journal:  e.journal,
+			cluster:  cl.name,
+		}, rc, unstructured)
+	}
 
 	return action.Execute(ctx, rc, unstructured)
 }
@@ -0,0 +1,191 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/feedback"
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// scriptedAction returns the scripted errors of an object in turn, and
+// succeeds once they are used up. Objects listed in slow take a while to
+// succeed, unless their context is cancelled first.
+type scriptedAction struct {
+	mtx      sync.Mutex
+	errs     map[string][]error
+	slow     map[string]bool
+	executed []string
+}
+
+func (a *scriptedAction) Name() string {
+	return "Scripted"
+}
+
+func (a *scriptedAction) Execute(ctx context.Context, rc *client.ResourceClient, u *unstructured.Unstructured) error {
+	a.mtx.Lock()
+	a.executed = append(a.executed, u.GetName())
+	var err error
+	if errs := a.errs[u.GetName()]; len(errs) > 0 {
+		err, a.errs[u.GetName()] = errs[0], errs[1:]
+	}
+	slow := a.slow[u.GetName()]
+	a.mtx.Unlock()
+
+	if err != nil || !slow {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
+
+func (a *scriptedAction) executions() []string {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	executed := append([]string{}, a.executed...)
+	sort.Strings(executed)
+	return executed
+}
+
+// scriptedRunner returns a runner that runs the Scripted action.
+func scriptedRunner(action *scriptedAction) *Runner {
+	r := NewRunner(nil, log.NewNopLogger(), discoveryClient(), nil, nil, DryRunNone)
+	r.SetObjectActions([]ObjectAction{action})
+	return r
+}
+
+// scriptedResult returns the render result of a ConfigMap per name, and of the
+// rollout of the groups.
+func scriptedResult(names []string, groups ...*types.RolloutGroup) *render.Result {
+	objects := map[string]*unstructured.Unstructured{}
+	for _, name := range names {
+		objects[name] = configMap(name, "value")
+	}
+	return &render.Result{
+		Objects: objects,
+		Rollout: &types.Rollout{Spec: &types.RolloutSpec{Groups: groups}},
+	}
+}
+
+func TestFailurePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy     types.FailurePolicy
+		err        bool
+		sibling    feedback.CurrentStatus
+		next       feedback.CurrentStatus
+		executed   []string
+		groupLabel string
+	}{{
+		policy:     types.FailurePolicyFailFast,
+		err:        true,
+		sibling:    feedback.StatusConditionFailed,
+		executed:   []string{"failing", "sibling"},
+		groupLabel: "failed",
+	}, {
+		policy:     types.FailurePolicyWaitForAll,
+		err:        true,
+		sibling:    feedback.StatusConditionFinished,
+		executed:   []string{"failing", "sibling"},
+		groupLabel: "failed",
+	}, {
+		policy:     types.FailurePolicyContinue,
+		sibling:    feedback.StatusConditionFinished,
+		next:       feedback.StatusConditionFinished,
+		executed:   []string{"failing", "next", "sibling"},
+		groupLabel: "continued",
+	}} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			action := &scriptedAction{
+				errs: map[string][]error{"failing": {errors.New("failed")}},
+				slow: map[string]bool{"sibling": true},
+			}
+			r := scriptedRunner(action)
+			f := &statusFeedback{statuses: map[string]feedback.CurrentStatus{}}
+			res := scriptedResult([]string{"failing", "sibling", "dependent", "next"}, &types.RolloutGroup{
+				Name:          "first",
+				Parallel:      true,
+				FailurePolicy: tc.policy,
+				Steps: []*types.Step{
+					{Name: "failing", Object: "failing", Action: "Scripted"},
+					{Name: "sibling", Object: "sibling", Action: "Scripted"},
+					{Name: "dependent", Object: "dependent", Action: "Scripted", DependsOn: []string{"failing"}},
+				},
+			}, &types.RolloutGroup{
+				Name:  "second",
+				Steps: []*types.Step{{Name: "next", Object: "next", Action: "Scripted"}},
+			})
+
+			err := r.Execute(context.Background(), &Config{Key: "test", Feedback: f, Rendered: res})
+			if tc.err && (err == nil || !strings.Contains(err.Error(), `failed to run group "first" (failure policy `+string(tc.policy)+`)`)) {
+				t.Fatalf("expected the group to fail the rollout, got %v", err)
+			}
+			if !tc.err && err != nil {
+				t.Fatalf("expected the rollout to continue, got %v", err)
+			}
+
+			if executed := action.executions(); !reflect.DeepEqual(executed, tc.executed) {
+				t.Fatalf("expected %v to be executed, got %v", tc.executed, executed)
+			}
+			for condition, expected := range map[string]feedback.CurrentStatus{
+				"first":           feedback.StatusConditionFailed,
+				"first/failing":   feedback.StatusConditionFailed,
+				"first/sibling":   tc.sibling,
+				"first/dependent": "",
+				"second":          tc.next,
+			} {
+				if s := f.statuses[condition]; s != expected {
+					t.Errorf("expected condition %s to be %q, got %q", condition, expected, s)
+				}
+			}
+			if v := testutil.ToFloat64(r.metrics.groups.WithLabelValues(string(tc.policy), tc.groupLabel)); v != 1 {
+				t.Fatalf("expected one group %s with failure policy %s, got %v", tc.groupLabel, tc.policy, v)
+			}
+			if v := testutil.ToFloat64(r.metrics.groups.WithLabelValues(string(tc.policy), "succeeded")); v != 0 {
+				t.Fatalf("expected no group to succeed with failure policy %s, got %v", tc.policy, v)
+			}
+		})
+	}
+}
+
+func TestSkippedGroupMetric(t *testing.T) {
+	action := &scriptedAction{}
+	r := scriptedRunner(action)
+	res := scriptedResult([]string{"skipped", "run"}, &types.RolloutGroup{
+		Name:  "skipped",
+		When:  "false",
+		Steps: []*types.Step{{Object: "skipped", Action: "Scripted"}},
+	}, &types.RolloutGroup{
+		Name:  "run",
+		Steps: []*types.Step{{Object: "run", Action: "Scripted"}},
+	})
+
+	if err := r.Execute(context.Background(), &Config{Key: "test", Rendered: res}); err != nil {
+		t.Fatal(err)
+	}
+	if executed := action.executions(); !reflect.DeepEqual(executed, []string{"run"}) {
+		t.Fatalf("expected only the group that isn't skipped to run, got %v", executed)
+	}
+	policy := string(types.FailurePolicyWaitForAll)
+	if v := testutil.ToFloat64(r.metrics.groups.WithLabelValues(policy, "skipped")); v != 1 {
+		t.Fatalf("expected one skipped group, got %v", v)
+	}
+	if v := testutil.ToFloat64(r.metrics.groups.WithLabelValues(policy, "succeeded")); v != 1 {
+		t.Fatalf("expected one succeeded group, got %v", v)
+	}
+}
@@ -20,20 +20,175 @@ type Metadata struct {
 type RolloutSpec struct {
 	Parallel bool            `json:"parallel"`
 	Groups   []*RolloutGroup `json:"groups"`
+	// RollbackOnFailure restores all objects touched by the rollout to the
+	// state they were in before the rollout, should any step fail.
+	RollbackOnFailure bool `json:"rollbackOnFailure"`
+	// IgnoreDifferences lists fields kept as they are in the cluster when
+	// objects of any step are updated.
+	IgnoreDifferences []*IgnoreDifference `json:"ignoreDifferences"`
 }
 
 type RolloutGroup struct {
 	Name     string  `json:"name"`
 	Parallel bool    `json:"parallel"`
 	Steps    []*Step `json:"steps"`
+	// DependsOn lists the names of groups that must have finished before
+	// this group is started, instead of the group before it. Groups without
+	// dependencies still wait for the group before them, unless the rollout
+	// is parallel.
+	DependsOn []string `json:"dependsOn"`
+	// FailurePolicy defines how the group reacts to failing steps, defaults
+	// to WaitForAll.
+	FailurePolicy FailurePolicy `json:"failurePolicy"`
+	// PreHooks are run in order before the group's steps are started.
+	PreHooks []*Hook `json:"preHooks"`
+	// PostHooks are run in order after all of the group's steps succeeded.
+	PostHooks []*Hook `json:"postHooks"`
+	// When is a CEL expression, the group is skipped unless it evaluates to
+	// true. It is evaluated against the configuration passed by the trigger
+	// as `config`, and the rendered objects by name as `objects`.
+	When string `json:"when"`
+	// Cluster is the name of the cluster the group's steps and hooks roll
+	// out to, one of the contexts of the clusters kubeconfig. Defaults to
+	// the cluster locutus runs against.
+	Cluster string `json:"cluster"`
 }
 
+// Hook runs a Job and waits for it to complete. A failed hook fails the
+// group it belongs to.
+type Hook struct {
+	// Object is the name of the rendered Job object.
+	Object string `json:"object"`
+	// DeletePolicy defines when the Job is deleted, defaults to
+	// BeforeCreation.
+	DeletePolicy HookDeletePolicy `json:"deletePolicy"`
+	// Timeout is how long to wait for the Job to complete, defaults to 10
+	// minutes.
+	Timeout Duration `json:"timeout"`
+}
+
+type HookDeletePolicy string
+
+const (
+	// HookDeletePolicyBeforeCreation deletes the Job left behind by a
+	// previous run before the hook's Job is created.
+	HookDeletePolicyBeforeCreation HookDeletePolicy = "BeforeCreation"
+	// HookDeletePolicyOnSuccess deletes the Job as soon as it succeeded,
+	// failed Jobs are kept for inspection.
+	HookDeletePolicyOnSuccess HookDeletePolicy = "OnSuccess"
+	// HookDeletePolicyNever never deletes the Job.
+	HookDeletePolicyNever HookDeletePolicy = "Never"
+)
+
+type FailurePolicy string
+
+const (
+	// FailurePolicyFailFast cancels all running steps of the group as soon
+	// as one step fails, and fails the group.
+	FailurePolicyFailFast FailurePolicy = "FailFast"
+	// FailurePolicyWaitForAll lets all steps that don't depend on a failed
+	// step run to completion, and then fails the group.
+	FailurePolicyWaitForAll FailurePolicy = "WaitForAll"
+	// FailurePolicyContinue lets all steps that don't depend on a failed
+	// step run to completion, and reports the group as failed, but
+	// continues the rollout as if it succeeded.
+	FailurePolicyContinue FailurePolicy = "Continue"
+)
+
 type Step struct {
 	Name            string               `json:"name"`
 	Object          string               `json:"object"`
 	Action          string               `json:"action"`
 	Success         []*SuccessDefinition `json:"success"`
 	ContinueOnError bool                 `json:"continueOnError"`
+	// DependsOn lists the names of steps within the same group that must
+	// have finished before this step is started, instead of the step before
+	// it. Steps without dependencies still wait for the step before them,
+	// unless the group is parallel.
+	DependsOn []string `json:"dependsOn"`
+	// Retry configures retrying the step's action and success checks,
+	// should they fail. Without it a step is attempted exactly once.
+	Retry *RetryPolicy `json:"retry"`
+	// When is a CEL expression, the step is skipped unless it evaluates to
+	// true. See RolloutGroup.When.
+	When string `json:"when"`
+	// Gate turns the step into a manual approval gate, that blocks until
+	// approved instead of executing an action on an object.
+	Gate *Gate `json:"gate"`
+	// Cluster overrides the cluster of the step's group, see
+	// RolloutGroup.Cluster.
+	Cluster string `json:"cluster"`
+	// IgnoreDifferences lists fields kept as they are in the cluster when
+	// the step's object is updated, in addition to those of the rollout.
+	IgnoreDifferences []*IgnoreDifference `json:"ignoreDifferences"`
+}
+
+// IgnoreDifference selects fields of objects of a kind that are owned by
+// other controllers, such as spec.replicas of a Deployment scaled by a
+// HorizontalPodAutoscaler. On update, they are copied from the object in the
+// cluster.
+type IgnoreDifference struct {
+	// Group is the API group of the kind, empty for the core API group.
+	Group string `json:"group"`
+	Kind  string `json:"kind"`
+	// JSONPointers are RFC 6901 JSON pointers, for example /spec/replicas.
+	JSONPointers []string `json:"jsonPointers"`
+	// JSONPaths are JSONPath expressions, for example
+	// .webhooks[*].clientConfig.caBundle.
+	JSONPaths []string `json:"jsonPaths"`
+}
+
+// Gate blocks a rollout until it is approved through any of the configured
+// sources, or through an HTTP request to locutus.
+type Gate struct {
+	// Annotation is the key of an annotation on the resource that triggered
+	// the rollout. The gate is approved once it is set to
+	// <approver>@<revision>, where the revision identifies the render
+	// result waiting for approval, as reported through feedback. The
+	// approver is recorded.
+	Annotation string `json:"annotation"`
+	// Database approves the gate once its query returns a row, the value
+	// of the row's first column is recorded as the approver.
+	Database *DatabaseGate `json:"database"`
+	// Timeout fails the gate if it isn't approved in time, gates wait
+	// indefinitely if not set.
+	Timeout Duration `json:"timeout"`
+}
+
+type DatabaseGate struct {
+	DatabaseName string              `json:"name"`
+	Query        DatabaseReportQuery `json:"query"`
+}
+
+type RetryPolicy struct {
+	// Attempts is the maximum number of times the step is attempted,
+	// including the first attempt.
+	Attempts       int      `json:"attempts"`
+	InitialBackoff Duration `json:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff"`
+	// RetryOn lists the classes of errors that are retried, defaults to all
+	// transient API errors (Conflict, ServerError, Timeout and
+	// TooManyRequests).
+	RetryOn []ErrorClass `json:"retryOn"`
+}
+
+type ErrorClass string
+
+const (
+	ErrorClassConflict        ErrorClass = "Conflict"
+	ErrorClassServerError     ErrorClass = "ServerError"
+	ErrorClassTimeout         ErrorClass = "Timeout"
+	ErrorClassTooManyRequests ErrorClass = "TooManyRequests"
+	// ErrorClassCheckFailed matches any failure of a step's success checks
+	// that isn't an API error of one of the other classes.
+	ErrorClassCheckFailed ErrorClass = "CheckFailed"
+)
+
+var DefaultRetryOn = []ErrorClass{
+	ErrorClassConflict,
+	ErrorClassServerError,
+	ErrorClassTimeout,
+	ErrorClassTooManyRequests,
 }
 
 type SuccessDefinition struct {
@@ -0,0 +1,100 @@
+package rollout
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// validate returns all problems of the rollout that would otherwise only
+// surface once the step they belong to is run, after earlier groups were
+// already rolled out.
+func (r *Runner) validate(res *render.Result) error {
+	var errs error
+	for _, d := range ignoreDifferences(res.Rollout.Spec, &types.Step{}) {
+		if err := d.Validate(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	for _, g := range res.Rollout.Spec.Groups {
+		if _, err := r.cluster(g.Cluster); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("group %q: %w", g.Name, err))
+		}
+		for _, h := range append(append([]*types.Hook{}, g.PreHooks...), g.PostHooks...) {
+			for _, err := range validateHook(res, h) {
+				errs = multierror.Append(errs, fmt.Errorf("group %q, hook %q: %w", g.Name, h.Object, err))
+			}
+		}
+		for _, s := range g.Steps {
+			for _, err := range r.validateStep(res, s) {
+				errs = multierror.Append(errs, fmt.Errorf("group %q, step %q: %w", g.Name, stepName(s), err))
+			}
+		}
+	}
+
+	return errs
+}
+
+func validateHook(res *render.Result, h *types.Hook) []error {
+	errs := []error{}
+	if _, found := res.Objects[h.Object]; !found {
+		errs = append(errs, fmt.Errorf("could not find object named %q", h.Object))
+	}
+	if h.Timeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("timeout must not be negative, got %s", h.Timeout.Duration))
+	}
+
+	return errs
+}
+
+func (r *Runner) validateStep(res *render.Result, s *types.Step) []error {
+	if s.Gate != nil {
+		return r.validateGate(s.Gate)
+	}
+
+	errs := []error{}
+	if _, found := res.Objects[s.Object]; !found {
+		errs = append(errs, fmt.Errorf("could not find object named %q", s.Object))
+	}
+	if _, err := r.objectAction(s.Action); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := r.cluster(s.Cluster); err != nil {
+		errs = append(errs, err)
+	}
+	for _, d := range ignoreDifferences(&types.RolloutSpec{}, s) {
+		if err := d.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if r.checks != nil {
+		switch err := r.checks.Validate(s.Success).(type) {
+		case nil:
+		case *multierror.Error:
+			errs = append(errs, err.Errors...)
+		default:
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+func (r *Runner) validateGate(g *types.Gate) []error {
+	errs := []error{}
+	if g.Database != nil {
+		if r.databaseConnections == nil {
+			errs = append(errs, fmt.Errorf("database connection %s not found", g.Database.DatabaseName))
+		} else if _, ok := r.databaseConnections.Connections[g.Database.DatabaseName]; !ok {
+			errs = append(errs, fmt.Errorf("database connection %s not found", g.Database.DatabaseName))
+		}
+	}
+	if g.Timeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("timeout must not be negative, got %s", g.Timeout.Duration))
+	}
+
+	return errs
+}
@@ -0,0 +1,65 @@
+package rollout
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/checks"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+func TestValidate(t *testing.T) {
+	c, err := checks.NewChecks(log.NewNopLogger(), nil, nil, checks.DefaultChecks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Runner{logger: log.NewNopLogger(), checks: c, actions: map[string]ObjectAction{}}
+	r.SetObjectActions(DefaultObjectActions)
+
+	second := types.Duration{Duration: time.Second}
+	res := &render.Result{
+		Objects: map[string]*unstructured.Unstructured{"cm": configMap("cm", "value")},
+		Rollout: &types.Rollout{Spec: &types.RolloutSpec{Groups: []*types.RolloutGroup{{
+			Name: "main",
+			Steps: []*types.Step{
+				{Name: "typo", Object: "cn", Action: "CreateOrUpdate"},
+				{Name: "action", Object: "cm", Action: "CreateOrUpdat"},
+				{Name: "checks", Object: "cm", Action: "CreateOrUpdate", Success: []*types.SuccessDefinition{{
+					FieldComparisons: &types.FieldComparisons{
+						ExpectedValues: []*types.ExpectedFieldComparisonValue{{Path: "{.status"}},
+						Timeout:        second,
+						PollInterval:   second,
+						ReportTimeout: &types.ReportConfig{Database: &types.DatabaseReportConfig{
+							DatabaseName: "missing",
+						}},
+						Failure: []*types.FailureDefinition{{CheckName: "unknown"}},
+					},
+				}}},
+				{Name: "gate", Gate: &types.Gate{Timeout: types.Duration{Duration: -time.Second}}},
+			},
+		}}}},
+	}
+
+	err = r.validate(res)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	for _, expected := range []string{
+		`step "typo": could not find object named "cn"`,
+		`step "action": unknown action "CreateOrUpdat"`,
+		`invalid path "{.status"`,
+		"progressTimeout must be positive",
+		"database connection missing not found",
+		`unknown failure check "unknown"`,
+		`step "gate": timeout must not be negative`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %q, got: %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package rollout
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"sigs.k8s.io/yaml"
+
+	"github.com/brancz/locutus/render"
+)
+
+// whenEnv is the CEL environment `when` expressions are compiled in. The
+// `config` variable holds the configuration passed by the trigger, and
+// `objects` the rendered objects by name.
+func whenEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("config", cel.DynType),
+		cel.Variable("objects", cel.MapType(cel.StringType, cel.DynType)),
+	)
+}
+
+func compileWhen(env *cel.Env, expr string) (cel.Program, error) {
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("invalid when expression %q: %w", expr, iss.Err())
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("when expression %q must evaluate to a bool, not %s", expr, ast.OutputType())
+	}
+
+	return env.Program(ast)
+}
+
+// whenVars returns the variables `when` expressions are evaluated against.
+func whenVars(config *Config, res *render.Result) (map[string]interface{}, error) {
+	var c interface{}
+	if config != nil && len(config.RawConfig) > 0 {
+		b, err := yaml.YAMLToJSON(config.RawConfig)
+		if err != nil {
+			return nil, fmt.Errorf("parse config: %w", err)
+		}
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, fmt.Errorf("parse config: %w", err)
+		}
+	}
+
+	objects := map[string]interface{}{}
+	for name, u := range res.Objects {
+		objects[name] = u.Object
+	}
+
+	return map[string]interface{}{
+		"config":  c,
+		"objects": objects,
+	}, nil
+}
+
+// evalWhen returns whether the program evaluates to true. A nil program
+// always does.
+func evalWhen(prg cel.Program, vars map[string]interface{}) (bool, error) {
+	if prg == nil {
+		return true, nil
+	}
+
+	out, _, err := prg.Eval(vars)
+	if err != nil {
+		return false, fmt.Errorf("evaluate when expression: %w", err)
+	}
+	v, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("when expression evaluated to %v, not a bool", out.Value())
+	}
+
+	return v, nil
+}
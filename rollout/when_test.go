@@ -0,0 +1,61 @@
+package rollout
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+func TestWhen(t *testing.T) {
+	migrate := &types.Step{Name: "migrate", When: "config.spec.database.enabled"}
+	cm := &types.Step{Name: "cm", When: `objects.cm.data.key == "value"`}
+	always := &types.Step{Name: "always"}
+	group := &types.RolloutGroup{Name: "main", Steps: []*types.Step{migrate, cm, always}, When: "has(config.spec)"}
+
+	p, err := newPlan(&types.RolloutSpec{Groups: []*types.RolloutGroup{group}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := whenVars(&Config{RawConfig: []byte(`{"spec":{"database":{"enabled":false}}}`)}, &render.Result{
+		Objects: map[string]*unstructured.Unstructured{"cm": configMap("cm", "value")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &execution{plan: p, whenVars: vars}
+
+	for _, tc := range []struct {
+		name    string
+		skipped bool
+		when    func() (bool, error)
+	}{
+		{name: "group", skipped: false, when: func() (bool, error) { return e.skipped(p.groupWhen[group]) }},
+		{name: "migrate", skipped: true, when: func() (bool, error) { return e.skipped(p.stepWhen[migrate]) }},
+		{name: "cm", skipped: false, when: func() (bool, error) { return e.skipped(p.stepWhen[cm]) }},
+		{name: "always", skipped: false, when: func() (bool, error) { return e.skipped(p.stepWhen[always]) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			skipped, err := tc.when()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skipped != tc.skipped {
+				t.Fatalf("expected skipped to be %t", tc.skipped)
+			}
+		})
+	}
+}
+
+func TestWhenInvalid(t *testing.T) {
+	_, err := newPlan(&types.RolloutSpec{Groups: []*types.RolloutGroup{{
+		Name:  "main",
+		Steps: []*types.Step{{Name: "migrate", When: `"not a bool"`}},
+	}}})
+	if err == nil {
+		t.Fatal("expected error for when expression not evaluating to a bool")
+	}
+}
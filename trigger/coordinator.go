@@ -0,0 +1,117 @@
+package trigger
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/brancz/locutus/rollout"
+)
+
+// Coordinator serializes executions per key. When an execution is started for
+// a key that is already executing, the in-flight execution is cancelled
+// through its context, and the new execution is started once it returned.
+// Executions of the same key never overlap.
+type Coordinator struct {
+	logger log.Logger
+	next   Execution
+
+	mtx      sync.Mutex
+	inFlight map[string]*inFlightExecution
+
+	superseded prometheus.Counter
+}
+
+type inFlightExecution struct {
+	cancel     context.CancelFunc
+	done       chan struct{}
+	superseded bool
+}
+
+func NewCoordinator(r prometheus.Registerer, logger log.Logger, next Execution) *Coordinator {
+	c := &Coordinator{
+		logger:   logger,
+		next:     next,
+		inFlight: map[string]*inFlightExecution{},
+		superseded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "trigger_executions_superseded_total",
+			Help: "Total number of in-flight executions cancelled in favor of a newer execution with the same key.",
+		}),
+	}
+
+	if r != nil {
+		r.MustRegister(c.superseded)
+	}
+
+	return c
+}
+
+func (c *Coordinator) Execute(ctx context.Context, config *rollout.Config) error {
+	key := ""
+	if config != nil {
+		key = config.Key
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	current := &inFlightExecution{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	c.mtx.Lock()
+	previous := c.inFlight[key]
+	c.inFlight[key] = current
+	if previous != nil {
+		previous.superseded = true
+		previous.cancel()
+	}
+	c.mtx.Unlock()
+
+	defer func() {
+		c.mtx.Lock()
+		if c.inFlight[key] == current {
+			delete(c.inFlight, key)
+		}
+		c.mtx.Unlock()
+		close(current.done)
+	}()
+
+	if previous != nil {
+		level.Info(c.logger).Log("msg", "superseding in-flight execution", "key", key)
+		c.superseded.Inc()
+
+		// Even if this execution is cancelled meanwhile, it must not
+		// return before the previous one did, as the next execution
+		// only waits for this one.
+		<-previous.done
+	}
+
+	if c.isSuperseded(current) {
+		level.Info(c.logger).Log("msg", "execution superseded before it started", "key", key)
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := c.next.Execute(ctx, config)
+	if err != nil && c.isSuperseded(current) {
+		// The newer execution takes over, so the cancellation is not a
+		// failure.
+		level.Info(c.logger).Log("msg", "execution superseded", "key", key, "err", err)
+		return nil
+	}
+
+	return err
+}
+
+func (c *Coordinator) isSuperseded(e *inFlightExecution) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return e.superseded
+}
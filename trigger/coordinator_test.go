@@ -0,0 +1,130 @@
+package trigger
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/brancz/locutus/rollout"
+)
+
+type executionFunc func(context.Context, *rollout.Config) error
+
+func (f executionFunc) Execute(ctx context.Context, config *rollout.Config) error {
+	return f(ctx, config)
+}
+
+func TestCoordinatorSupersedes(t *testing.T) {
+	started := make(chan struct{})
+	var runs []string
+	c := NewCoordinator(prometheus.NewRegistry(), log.NewNopLogger(), executionFunc(func(ctx context.Context, config *rollout.Config) error {
+		runs = append(runs, string(config.RawConfig))
+		if string(config.RawConfig) == "first" {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}))
+
+	firstErr := make(chan error)
+	go func() {
+		firstErr <- c.Execute(context.Background(), &rollout.Config{Key: "a", RawConfig: []byte("first")})
+	}()
+	<-started
+
+	if err := c.Execute(context.Background(), &rollout.Config{Key: "a", RawConfig: []byte("second")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-firstErr; err != nil {
+		t.Fatalf("expected superseded execution to not fail, got: %v", err)
+	}
+
+	if len(runs) != 2 || runs[0] != "first" || runs[1] != "second" {
+		t.Fatalf("unexpected runs %v", runs)
+	}
+	if n := testutil.ToFloat64(c.superseded); n != 1 {
+		t.Fatalf("expected 1 superseded execution, got %v", n)
+	}
+}
+
+func TestCoordinatorRunsKeysConcurrently(t *testing.T) {
+	release := make(chan struct{})
+	c := NewCoordinator(nil, log.NewNopLogger(), executionFunc(func(ctx context.Context, config *rollout.Config) error {
+		if config.Key == "a" {
+			<-release
+		}
+		return ctx.Err()
+	}))
+
+	errs := make(chan error)
+	go func() {
+		errs <- c.Execute(context.Background(), &rollout.Config{Key: "a"})
+	}()
+
+	if err := c.Execute(context.Background(), &rollout.Config{Key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoordinatorNeverOverlaps(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		running int
+		overlap bool
+	)
+	started := make(chan struct{}, 3)
+	c := NewCoordinator(nil, log.NewNopLogger(), executionFunc(func(ctx context.Context, config *rollout.Config) error {
+		mtx.Lock()
+		running++
+		if running > 1 {
+			overlap = true
+		}
+		mtx.Unlock()
+		started <- struct{}{}
+
+		// Cleaning up takes a while after being cancelled.
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+
+		mtx.Lock()
+		running--
+		mtx.Unlock()
+		return ctx.Err()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 3)
+	go func() {
+		errs <- c.Execute(ctx, &rollout.Config{Key: "a"})
+	}()
+	<-started
+	// The second execution is superseded while waiting for the first.
+	go func() {
+		errs <- c.Execute(ctx, &rollout.Config{Key: "a"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		errs <- c.Execute(ctx, &rollout.Config{Key: "a"})
+	}()
+	<-started
+	cancel()
+
+	for i := 0; i < 3; i++ {
+		<-errs
+	}
+	if overlap {
+		t.Fatal("executions of the same key overlapped")
+	}
+}
@@ -48,7 +48,8 @@ type TriggerRun struct {
 	logger log.Logger
 	runner *TriggerRunner
 
-	key string
+	triggerName string
+	key         string
 
 	mtx  *sync.Mutex
 	done bool
@@ -72,6 +73,7 @@ func (t *TriggerRun) Run(ctx context.Context, payload []byte) {
 func (t *TriggerRun) run(ctx context.Context, payload []byte) error {
 	level.Debug(t.logger).Log("msg", "triggered", "key", t.key)
 	return t.runner.Execute(ctx, &rollout.Config{
+		Key:       t.triggerName + "/" + t.key,
 		RawConfig: payload,
 	})
 }
@@ -137,7 +139,7 @@ func (t *TriggerRunner) runTrigger(ctx context.Context, triggerConfig TriggerCon
 func (t *TriggerRunner) checkTrigger(ctx context.Context, c TriggerConfig) error {
 	for key, trigger := range t.activeTriggers[c.Name] {
 		if trigger.Done() {
-			delete(t.activeTriggers, key)
+			delete(t.activeTriggers[c.Name], key)
 		}
 	}
 
@@ -155,12 +157,13 @@ func (t *TriggerRunner) checkTrigger(ctx context.Context, c TriggerConfig) error
 }
 
 func (t *TriggerRunner) ScheduleTriggerRun(ctx context.Context, triggerName, key string, payload []byte) {
-	if _, ok := t.activeTriggers[key]; !ok {
+	if _, ok := t.activeTriggers[triggerName][key]; !ok {
 		run := &TriggerRun{
-			logger: t.logger,
-			key:    key,
-			runner: t,
-			mtx:    &sync.Mutex{},
+			logger:      t.logger,
+			triggerName: triggerName,
+			key:         key,
+			runner:      t,
+			mtx:         &sync.Mutex{},
 		}
 		t.activeTriggers[triggerName][key] = run
 
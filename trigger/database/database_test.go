@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/brancz/locutus/db"
+	"github.com/brancz/locutus/rollout"
+)
+
+type executionFunc func(context.Context, *rollout.Config) error
+
+func (f executionFunc) Execute(ctx context.Context, config *rollout.Config) error {
+	return f(ctx, config)
+}
+
+func TestScheduleTriggerRun(t *testing.T) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	tr := &TriggerRunner{
+		logger: log.NewNopLogger(),
+		db:     &db.Connections{},
+		activeTriggers: map[string]map[string]*TriggerRun{
+			"a": {},
+			"b": {},
+		},
+	}
+	tr.Register(executionFunc(func(ctx context.Context, config *rollout.Config) error {
+		started <- config.Key
+		<-release
+		return nil
+	}))
+
+	expectStarted := func(expected string) {
+		t.Helper()
+		select {
+		case key := <-started:
+			if key != expected {
+				t.Fatalf("expected run of %s, got %s", expected, key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected run of %s to start", expected)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case key := <-started:
+			t.Fatalf("expected no run to start, got %s", key)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	ctx := context.Background()
+	tr.ScheduleTriggerRun(ctx, "a", "key", nil)
+	expectStarted("a/key")
+
+	// A key is only run once at a time per trigger, but the same key of
+	// another trigger is run independently.
+	tr.ScheduleTriggerRun(ctx, "a", "key", nil)
+	expectNone()
+	tr.ScheduleTriggerRun(ctx, "b", "key", nil)
+	expectStarted("b/key")
+
+	close(release)
+	run := tr.activeTriggers["a"]["key"]
+	for !run.Done() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Done runs are removed when the trigger is checked next, so that the
+	// key is run again. Checking fails without a database connection.
+	if err := tr.checkTrigger(ctx, TriggerConfig{Name: "a", DatabaseName: "missing"}); err == nil {
+		t.Fatal("expected checking the trigger to fail without a connection")
+	}
+	if _, ok := tr.activeTriggers["a"]["key"]; ok {
+		t.Fatal("expected the done run to be removed")
+	}
+	if _, ok := tr.activeTriggers["b"]; !ok {
+		t.Fatal("expected the runs of other triggers to be kept")
+	}
+	tr.ScheduleTriggerRun(ctx, "a", "key", nil)
+	expectStarted("a/key")
+}
@@ -231,7 +231,9 @@ func (p *Trigger) sync(ctx context.Context, key string) error {
 	}
 
 	return p.Execute(ctx, &rollout.Config{
+		Key:       key,
 		RawConfig: cfg,
 		Feedback:  f,
+		Object:    obj.(*unstructured.Unstructured),
 	})
 }
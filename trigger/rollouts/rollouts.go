@@ -0,0 +1,458 @@
+package rollouts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/feedback"
+	"github.com/brancz/locutus/render"
+	"github.com/brancz/locutus/rollout"
+	"github.com/brancz/locutus/rollout/types"
+	"github.com/brancz/locutus/trigger"
+)
+
+const (
+	APIVersion = "workflow.kubernetes.io/v1alpha1"
+	Kind       = "Rollout"
+
+	resyncPeriod = 0
+)
+
+var crdGroupKind = schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}
+
+// Rollout is a rollout stored in the cluster. Next to the groups of the
+// rollout spec, its spec holds the objects to roll out, inline or in
+// referenced ConfigMaps.
+type Rollout struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              RolloutSpec `json:"spec"`
+}
+
+type RolloutSpec struct {
+	types.RolloutSpec
+	// Objects are the objects to roll out by name.
+	Objects map[string]map[string]interface{} `json:"objects"`
+	// ObjectsFrom lists sources of further objects to roll out.
+	ObjectsFrom []*ObjectsSource `json:"objectsFrom"`
+}
+
+type ObjectsSource struct {
+	// ConfigMapRef references a ConfigMap in the namespace of the Rollout.
+	// Each of its keys holds a YAML or JSON object, named by the key.
+	ConfigMapRef *corev1.LocalObjectReference `json:"configMapRef"`
+}
+
+// Trigger executes the Rollouts in the cluster whenever their spec, or a
+// ConfigMap they reference, changes. Progress is written into the status of
+// the Rollout.
+//
+// A Rollout only rolls out objects into its own namespace, so that anyone
+// allowed to create Rollouts in a namespace can't change others. Namespaced
+// objects without a namespace are placed in it, and cluster-scoped objects
+// are rejected unless allowClusterScoped is set. For the same reason, a
+// Rollout can't roll out to other clusters or query databases.
+type Trigger struct {
+	trigger.ExecutionRegister
+
+	logger             log.Logger
+	client             *client.Client
+	allowClusterScoped bool
+
+	inf           cache.SharedIndexInformer
+	configMapsInf cache.SharedIndexInformer
+	queue         workqueue.RateLimitingInterface
+}
+
+func NewTrigger(
+	ctx context.Context,
+	logger log.Logger,
+	client *client.Client,
+	namespace string,
+	allowClusterScoped bool,
+) (*Trigger, error) {
+	t := &Trigger{
+		logger:             logger,
+		client:             client,
+		allowClusterScoped: allowClusterScoped,
+		queue:              workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "rollouts"),
+	}
+
+	c, err := client.ClientFor(APIVersion, Kind, namespace)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create client for %s in %s, is the Rollout CRD installed?", Kind, APIVersion)
+	}
+	t.inf = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return c.List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return c.Watch(ctx, options)
+			},
+		},
+		&unstructured.Unstructured{}, resyncPeriod, cache.Indexers{},
+	)
+	t.inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: t.enqueue,
+		UpdateFunc: func(old, cur interface{}) {
+			// Writing the status doesn't change the generation, which
+			// would otherwise trigger the Rollout again.
+			if old.(*unstructured.Unstructured).GetGeneration() == cur.(*unstructured.Unstructured).GetGeneration() {
+				return
+			}
+			t.enqueue(cur)
+		},
+	})
+
+	t.configMapsInf = informers.NewSharedInformerFactoryWithOptions(
+		client.KubeClient(),
+		resyncPeriod,
+		informers.WithNamespace(namespace),
+	).Core().V1().ConfigMaps().Informer()
+	t.configMapsInf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: t.enqueueReferencing,
+		UpdateFunc: func(old, cur interface{}) {
+			if old.(*corev1.ConfigMap).ResourceVersion == cur.(*corev1.ConfigMap).ResourceVersion {
+				return
+			}
+			t.enqueueReferencing(cur)
+		},
+		DeleteFunc: t.enqueueReferencing,
+	})
+
+	return t, nil
+}
+
+func (t *Trigger) Run(ctx context.Context) error {
+	defer t.queue.ShutDown()
+
+	t.logger.Log("msg", "rollouts trigger started")
+
+	go t.inf.Run(ctx.Done())
+	go t.configMapsInf.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), t.inf.HasSynced, t.configMapsInf.HasSynced) {
+		return ctx.Err()
+	}
+
+	go t.worker(ctx)
+
+	<-ctx.Done()
+	return nil
+}
+
+func (t *Trigger) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+
+	t.queue.Add(key)
+}
+
+// enqueueReferencing enqueues all Rollouts referencing the ConfigMap.
+func (t *Trigger) enqueueReferencing(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	for _, o := range t.inf.GetStore().List() {
+		u := o.(*unstructured.Unstructured)
+		if u.GetNamespace() != cm.Namespace {
+			continue
+		}
+		r, err := parseRollout(u)
+		if err != nil {
+			continue
+		}
+		if referencesConfigMap(r, cm.Name) {
+			level.Debug(t.logger).Log("msg", "referenced ConfigMap changed", "configmap", cm.Name, "rollout", r.Name)
+			t.enqueue(u)
+		}
+	}
+}
+
+func referencesConfigMap(r *Rollout, name string) bool {
+	for _, src := range r.Spec.ObjectsFrom {
+		if src.ConfigMapRef != nil && src.ConfigMapRef.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Trigger) worker(ctx context.Context) {
+	for t.processNextWorkItem(ctx) {
+	}
+}
+
+func (t *Trigger) processNextWorkItem(ctx context.Context) bool {
+	key, quit := t.queue.Get()
+	if quit {
+		return false
+	}
+	defer t.queue.Done(key)
+
+	err := t.sync(ctx, key.(string))
+	if err == nil {
+		t.queue.Forget(key)
+		return true
+	}
+
+	level.Error(t.logger).Log("msg", "sync failed", "key", key, "err", err)
+
+	utilruntime.HandleError(errors.Wrap(err, fmt.Sprintf("Sync %q failed", key)))
+	t.queue.AddRateLimited(key)
+
+	return true
+}
+
+func (t *Trigger) sync(ctx context.Context, key string) error {
+	level.Debug(t.logger).Log("msg", "sync triggered", "key", key)
+
+	obj, exists, err := t.inf.GetIndexer().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	u := obj.(*unstructured.Unstructured)
+
+	r, err := parseRollout(u)
+	if err != nil {
+		return err
+	}
+	res, err := renderRollout(ctx, t.client, r, t.allowClusterScoped)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	// Keys are prefixed, so that a Rollout doesn't share its inventory,
+	// history and executions with a resource of the same name watched by
+	// another trigger.
+	return t.Execute(ctx, &rollout.Config{
+		Key:       "rollout/" + key,
+		RawConfig: cfg,
+		Feedback:  feedback.NewFeedback(t.logger, t.client, u),
+		Object:    u,
+		Rendered:  res,
+	})
+}
+
+// placeObject sets the namespace of the Rollout on the object, or on each item
+// if the object is a list, and rejects it if it belongs elsewhere. Objects of
+// kinds the API server doesn't serve are only accepted if their kind is
+// defined by a CustomResourceDefinition of the same Rollout, whose scope is
+// given in defined.
+func placeObject(cl *client.Client, r *Rollout, u *unstructured.Unstructured, allowClusterScoped bool, defined map[schema.GroupKind]bool) error {
+	if u.IsList() {
+		return u.EachListItem(func(o runtime.Object) error {
+			return placeObject(cl, r, o.(*unstructured.Unstructured), allowClusterScoped, defined)
+		})
+	}
+
+	namespaced, err := cl.IsNamespaced(u.GetAPIVersion(), u.GetKind())
+	var unknown *client.UnknownKindError
+	if errors.As(err, &unknown) {
+		if n, ok := defined[u.GroupVersionKind().GroupKind()]; ok {
+			namespaced, err = n, nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !namespaced {
+		if !allowClusterScoped {
+			return fmt.Errorf("cluster-scoped %s %s not allowed", u.GetKind(), u.GetName())
+		}
+		return nil
+	}
+
+	switch u.GetNamespace() {
+	case "":
+		u.SetNamespace(r.Namespace)
+	case r.Namespace:
+	default:
+		return fmt.Errorf("namespace %s differs from the Rollout's namespace %s", u.GetNamespace(), r.Namespace)
+	}
+	return nil
+}
+
+// definedKinds adds the kinds defined by CustomResourceDefinitions among the
+// objects to defined, and whether they are namespaced.
+func definedKinds(u *unstructured.Unstructured, defined map[schema.GroupKind]bool) {
+	if u.IsList() {
+		_ = u.EachListItem(func(o runtime.Object) error {
+			definedKinds(o.(*unstructured.Unstructured), defined)
+			return nil
+		})
+		return
+	}
+	if u.GroupVersionKind().GroupKind() != crdGroupKind {
+		return
+	}
+
+	group, _, _ := unstructured.NestedString(u.Object, "spec", "group")
+	kind, _, _ := unstructured.NestedString(u.Object, "spec", "names", "kind")
+	scope, _, _ := unstructured.NestedString(u.Object, "spec", "scope")
+	defined[schema.GroupKind{Group: group, Kind: kind}] = scope == "Namespaced"
+}
+
+// restrictSpec rejects the parts of a Rollout's spec that reach beyond its
+// namespace: rolling out to other clusters, and queries against the database
+// connections of locutus in gates and reports.
+func restrictSpec(spec *types.RolloutSpec) error {
+	for _, g := range spec.Groups {
+		if g.Cluster != "" {
+			return fmt.Errorf("group %q: cluster not allowed in Rollout objects", g.Name)
+		}
+		for _, s := range g.Steps {
+			name := s.Name
+			if name == "" {
+				name = s.Object
+			}
+			if s.Cluster != "" {
+				return fmt.Errorf("group %q, step %q: cluster not allowed in Rollout objects", g.Name, name)
+			}
+			if s.Gate != nil && s.Gate.Database != nil {
+				return fmt.Errorf("group %q, step %q: database gates not allowed in Rollout objects", g.Name, name)
+			}
+			if reportsToDatabase(s.Success) {
+				return fmt.Errorf("group %q, step %q: database reports not allowed in Rollout objects", g.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+func reportsToDatabase(success []*types.SuccessDefinition) bool {
+	failures := []*types.FailureDefinition{}
+	for _, s := range success {
+		failures = append(failures, s.Failure...)
+		if c := s.FieldComparisons; c != nil {
+			if c.ReportTimeout != nil && c.ReportTimeout.Database != nil {
+				return true
+			}
+			failures = append(failures, c.Failure...)
+		}
+	}
+	for _, f := range failures {
+		if f.Report != nil && f.Report.Database != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRollout(u *unstructured.Unstructured) (*Rollout, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rollout{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse Rollout %s/%s", u.GetNamespace(), u.GetName())
+	}
+
+	return r, nil
+}
+
+// renderRollout collects the objects of the Rollout, from its spec and the
+// ConfigMaps it references. Namespaced objects are placed in the namespace of
+// the Rollout, objects in other namespaces are rejected, and so are
+// cluster-scoped objects unless allowClusterScoped is set. Rollouts rolling
+// out to other clusters or querying databases are rejected too.
+func renderRollout(ctx context.Context, client *client.Client, r *Rollout, allowClusterScoped bool) (*render.Result, error) {
+	if err := restrictSpec(&r.Spec.RolloutSpec); err != nil {
+		return nil, err
+	}
+
+	objects := map[string]*unstructured.Unstructured{}
+	add := func(name string, object map[string]interface{}) error {
+		if _, ok := objects[name]; ok {
+			return fmt.Errorf("object %q defined more than once", name)
+		}
+		objects[name] = &unstructured.Unstructured{Object: object}
+		return nil
+	}
+
+	for name, object := range r.Spec.Objects {
+		if err := add(name, object); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, src := range r.Spec.ObjectsFrom {
+		if src.ConfigMapRef == nil {
+			continue
+		}
+		cm, err := client.KubeClient().CoreV1().ConfigMaps(r.Namespace).Get(ctx, src.ConfigMapRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get ConfigMap %s", src.ConfigMapRef.Name)
+		}
+		for name, data := range cm.Data {
+			object := map[string]interface{}{}
+			if err := yaml.Unmarshal([]byte(data), &object); err != nil {
+				return nil, errors.Wrapf(err, "failed to parse object %q of ConfigMap %s", name, cm.Name)
+			}
+			if err := add(name, object); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Objects are placed once all of them are known, as custom resources
+	// may be of kinds defined by the Rollout itself.
+	defined := map[schema.GroupKind]bool{}
+	names := make([]string, 0, len(objects))
+	for name, u := range objects {
+		definedKinds(u, defined)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := placeObject(client, r, objects[name], allowClusterScoped, defined); err != nil {
+			return nil, fmt.Errorf("object %q: %w", name, err)
+		}
+	}
+
+	spec := r.Spec.RolloutSpec
+	return &render.Result{
+		Objects: objects,
+		Rollout: &types.Rollout{
+			APIVersion: r.APIVersion,
+			Kind:       r.Kind,
+			Metadata:   &types.Metadata{Name: r.Name},
+			Spec:       &spec,
+		},
+	}, nil
+}
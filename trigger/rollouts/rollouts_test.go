@@ -0,0 +1,266 @@
+package rollouts
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/brancz/locutus/client"
+	"github.com/brancz/locutus/rollout"
+	"github.com/brancz/locutus/rollout/types"
+)
+
+// discoveryClient returns a client that knows Services, Deployments,
+// Namespaces and CustomResourceDefinitions, with the given objects.
+func discoveryClient(objects ...runtime.Object) *client.Client {
+	kc := kubefake.NewSimpleClientset(objects...)
+	kc.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "services", Kind: "Service", Namespaced: true},
+			{Name: "namespaces", Kind: "Namespace", Namespaced: false},
+		},
+	}, {
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true}},
+	}, {
+		GroupVersion: "apiextensions.k8s.io/v1",
+		APIResources: []metav1.APIResource{{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition", Namespaced: false}},
+	}}
+	return client.NewClient(nil, kc)
+}
+
+func TestRenderRollout(t *testing.T) {
+	cl := discoveryClient(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "objects", Namespace: "default"},
+		Data: map[string]string{
+			"deployment": "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\nspec:\n  replicas: 2\n",
+		},
+	})
+
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": APIVersion,
+		"kind":       Kind,
+		"metadata": map[string]interface{}{
+			"name":      "app",
+			"namespace": "default",
+		},
+		"spec": map[string]interface{}{
+			"groups": []interface{}{map[string]interface{}{
+				"name": "main",
+				"steps": []interface{}{
+					map[string]interface{}{"object": "service", "action": "CreateOrUpdate"},
+					map[string]interface{}{"object": "deployment", "action": "CreateOrUpdate"},
+				},
+			}},
+			"objects": map[string]interface{}{
+				"service": map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "Service",
+					"metadata":   map[string]interface{}{"name": "app"},
+				},
+			},
+			"objectsFrom": []interface{}{map[string]interface{}{
+				"configMapRef": map[string]interface{}{"name": "objects"},
+			}},
+		},
+	}}
+
+	r, err := parseRollout(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !referencesConfigMap(r, "objects") {
+		t.Fatal("expected Rollout to reference ConfigMap objects")
+	}
+
+	res, err := renderRollout(context.Background(), cl, r, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Rollout.Spec.Groups) != 1 || len(res.Rollout.Spec.Groups[0].Steps) != 2 {
+		t.Fatalf("unexpected rollout spec %+v", res.Rollout.Spec)
+	}
+	if res.Objects["service"].GetKind() != "Service" || res.Objects["service"].GetNamespace() != "default" {
+		t.Fatalf("unexpected service object %v", res.Objects["service"])
+	}
+	replicas, _, _ := unstructured.NestedInt64(res.Objects["deployment"].Object, "spec", "replicas")
+	if res.Objects["deployment"].GetName() != "app" || replicas != 2 {
+		t.Fatalf("unexpected deployment object %v", res.Objects["deployment"])
+	}
+}
+
+func TestRenderRolloutRestrictsNamespace(t *testing.T) {
+	rollout := func(objects ...map[string]interface{}) *Rollout {
+		r := &Rollout{}
+		r.Name = "app"
+		r.Namespace = "team"
+		r.Spec.Objects = map[string]map[string]interface{}{}
+		for i, object := range objects {
+			r.Spec.Objects[fmt.Sprintf("object-%d", i)] = object
+		}
+		return r
+	}
+	object := func(apiVersion, kind, namespace string) map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       kind,
+			"metadata":   map[string]interface{}{"name": "app", "namespace": namespace},
+		}
+	}
+	list := func(items ...map[string]interface{}) map[string]interface{} {
+		l := map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": []interface{}{}}
+		for _, item := range items {
+			l["items"] = append(l["items"].([]interface{}), item)
+		}
+		return l
+	}
+	crd := func(scope string) map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": "apiextensions.k8s.io/v1",
+			"kind":       "CustomResourceDefinition",
+			"metadata":   map[string]interface{}{"name": "widgets.example.com"},
+			"spec": map[string]interface{}{
+				"group": "example.com",
+				"names": map[string]interface{}{"kind": "Widget", "plural": "widgets"},
+				"scope": scope,
+			},
+		}
+	}
+	cl := discoveryClient()
+
+	for _, tc := range []struct {
+		name               string
+		objects            []map[string]interface{}
+		allowClusterScoped bool
+		valid              bool
+	}{
+		{name: "own namespace", objects: []map[string]interface{}{object("v1", "Service", "team")}, valid: true},
+		{name: "other namespace", objects: []map[string]interface{}{object("v1", "Service", "kube-system")}},
+		{name: "cluster-scoped", objects: []map[string]interface{}{object("v1", "Namespace", "")}},
+		{name: "allowed cluster-scoped", objects: []map[string]interface{}{object("v1", "Namespace", "")}, allowClusterScoped: true, valid: true},
+		{name: "unknown kind", objects: []map[string]interface{}{object("example.com/v1", "Widget", "")}},
+		{name: "allowed unknown kind", objects: []map[string]interface{}{object("example.com/v1", "Widget", "")}, allowClusterScoped: true},
+		{name: "kind defined by the Rollout", objects: []map[string]interface{}{crd("Namespaced"), object("example.com/v1", "Widget", "")}, allowClusterScoped: true, valid: true},
+		{name: "kind defined by the Rollout in other namespace", objects: []map[string]interface{}{crd("Namespaced"), object("example.com/v1", "Widget", "kube-system")}, allowClusterScoped: true},
+		{name: "list in own namespace", objects: []map[string]interface{}{list(object("v1", "Service", ""), object("apps/v1", "Deployment", "team"))}, valid: true},
+		{name: "list with other namespace", objects: []map[string]interface{}{list(object("v1", "Service", ""), object("apps/v1", "Deployment", "kube-system"))}, allowClusterScoped: true},
+		{name: "list with unknown kind", objects: []map[string]interface{}{list(object("example.com/v1", "Widget", ""))}, allowClusterScoped: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := renderRollout(context.Background(), cl, rollout(tc.objects...), tc.allowClusterScoped)
+			if tc.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected the object to be rejected")
+			}
+			if err != nil {
+				return
+			}
+			for _, u := range res.Objects {
+				err := u.EachListItem(func(o runtime.Object) error {
+					if ns := o.(*unstructured.Unstructured).GetNamespace(); ns != "team" {
+						return fmt.Errorf("expected list item to be placed in namespace team, got %q", ns)
+					}
+					return nil
+				})
+				if u.IsList() && err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderRolloutRestrictsSpec(t *testing.T) {
+	database := &types.ReportConfig{Database: &types.DatabaseReportConfig{DatabaseName: "db"}}
+	for _, tc := range []struct {
+		name  string
+		group *types.RolloutGroup
+		valid bool
+	}{
+		{name: "plain", group: &types.RolloutGroup{Name: "main", Steps: []*types.Step{{Object: "service"}}}, valid: true},
+		{name: "group cluster", group: &types.RolloutGroup{Name: "main", Cluster: "prod"}},
+		{name: "step cluster", group: &types.RolloutGroup{Name: "main", Steps: []*types.Step{{Object: "service", Cluster: "prod"}}}},
+		{name: "database gate", group: &types.RolloutGroup{Name: "main", Steps: []*types.Step{{Name: "approve", Gate: &types.Gate{Database: &types.DatabaseGate{DatabaseName: "db"}}}}}},
+		{name: "annotation gate", group: &types.RolloutGroup{Name: "main", Steps: []*types.Step{{Name: "approve", Gate: &types.Gate{Annotation: "approved"}}}}, valid: true},
+		{name: "database failure report", group: &types.RolloutGroup{Name: "main", Steps: []*types.Step{{Object: "service", Success: []*types.SuccessDefinition{{
+			Failure: []*types.FailureDefinition{{Report: database}},
+		}}}}}},
+		{name: "database timeout report", group: &types.RolloutGroup{Name: "main", Steps: []*types.Step{{Object: "service", Success: []*types.SuccessDefinition{{
+			FieldComparisons: &types.FieldComparisons{ReportTimeout: database},
+		}}}}}},
+		{name: "database field comparison failure report", group: &types.RolloutGroup{Name: "main", Steps: []*types.Step{{Object: "service", Success: []*types.SuccessDefinition{{
+			FieldComparisons: &types.FieldComparisons{Failure: []*types.FailureDefinition{{Report: database}}},
+		}}}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Rollout{}
+			r.Name = "app"
+			r.Namespace = "team"
+			r.Spec.Groups = []*types.RolloutGroup{tc.group}
+
+			_, err := renderRollout(context.Background(), discoveryClient(), r, false)
+			if tc.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected the spec to be rejected")
+			}
+		})
+	}
+}
+
+type recordingExecution struct {
+	configs []*rollout.Config
+}
+
+func (e *recordingExecution) Execute(ctx context.Context, config *rollout.Config) error {
+	e.configs = append(e.configs, config)
+	return nil
+}
+
+func TestSyncKey(t *testing.T) {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": APIVersion,
+		"kind":       Kind,
+		"metadata": map[string]interface{}{
+			"name":      "app",
+			"namespace": "team",
+		},
+		"spec": map[string]interface{}{},
+	}}
+
+	tr := &Trigger{
+		logger: log.NewNopLogger(),
+		client: discoveryClient(),
+		inf:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &unstructured.Unstructured{}, resyncPeriod, cache.Indexers{}),
+	}
+	if err := tr.inf.GetIndexer().Add(u); err != nil {
+		t.Fatal(err)
+	}
+	e := &recordingExecution{}
+	tr.Register(e)
+
+	if err := tr.sync(context.Background(), "team/app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.configs) != 1 {
+		t.Fatalf("expected one execution, got %d", len(e.configs))
+	}
+	// Differs from the key of the resource trigger for the same name.
+	if e.configs[0].Key != "rollout/team/app" {
+		t.Fatalf("expected key rollout/team/app, got %q", e.configs[0].Key)
+	}
+}